@@ -2,4 +2,11 @@ module github.com/newde36524/ew
 
 go 1.23
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/sys v0.26.0
+	golang.org/x/time v0.7.0
+	gvisor.dev/gvisor v0.0.0-20240722211153-64c016c92987
+)
+
+require github.com/google/btree v1.1.2 // indirect
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
+	"strings"
 
 	"github.com/newde36524/ew/utils/log"
 
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/newde36524/ew/utils"
 	"github.com/newde36524/ew/worker"
@@ -16,13 +22,61 @@ import (
 // ======================== 全局参数 ========================
 
 var (
-	listenAddr  string
-	serverAddr  string
-	serverIP    string
-	token       string
-	dnsServer   string
-	echDomain   string
-	routingMode string // 分流模式: "global", "bypass_cn", "none"
+	listenAddr   string
+	serverAddr   string
+	serverIP     string
+	token        string
+	dnsServer    string
+	echDomain    string
+	echPolicy    string  // ECH 策略: required, preferred, disabled
+	routingMode  string  // 分流模式: "global", "bypass_cn", "none"
+	redirAddr    string  // REDIRECT 透明代理监听地址
+	tproxyAddr   string  // TPROXY 透明代理监听地址
+	tunName      string  // TUN 设备名
+	tunAddr      string  // TUN 设备地址
+	tunMTU       int     // TUN 设备 MTU
+	tunRoute     bool    // 自动配置 TUN 路由
+	dnsListen    string  // 内置 DNS 监听地址
+	dnsMode      string  // 内置 DNS 模式
+	dnsDomestic  string  // 国内域名 DoH 服务器
+	fakeIPRange  string  // fake-ip 地址段
+	dnsCache     int     // DNS 缓存记录数
+	dnsMinTTL    int     // DNS 缓存最短时间（秒）
+	dnsMaxTTL    int     // DNS 缓存最长时间（秒）
+	dohGet       bool    // DoH 使用 GET 请求
+	dohRace      bool    // 多个 DoH 服务器竞速
+	configFile   string  // 服务端配置文件
+	poolMinIdle  int     // 预热连接池最少空闲连接数
+	poolMaxIdle  int     // 预热连接池最多空闲连接数
+	poolMaxAge   int     // 空闲连接最长存活时间（秒）
+	poolPing     int     // 空闲连接保活间隔（秒）
+	earlyData    bool    // SOCKS5 首包随 CONNECT 发送
+	idleTimeout  int     // 隧道空闲超时（秒）
+	maxLifetime  int     // 隧道最长存活时间（秒）
+	handshakeTO  int     // SOCKS5 / HTTP 握手超时（秒）
+	tcpKeepAlive int     // 接入连接 TCP keepalive 间隔（秒）
+	bwGlobal     string  // 全局带宽限制（上行/下行）
+	bwClient     string  // 每个客户端 IP 带宽限制
+	bwUser       string  // 每个认证用户带宽限制
+	authUsers    string  // SOCKS5 / HTTP 认证用户（用户名:密码）
+	authFile     string  // 认证用户文件
+	bwProxy      string  // 代理流量带宽限制
+	bwDirect     string  // 直连流量带宽限制
+	maxTunnels   int     // 全局并发隧道数
+	maxClientTun int     // 每个客户端 IP 并发隧道数
+	tunnelRate   float64 // 全局每秒新建隧道数
+	clientRate   float64 // 每个客户端 IP 每秒新建隧道数
+	tunnelQueue  int     // 超出限制时排队等待时间（秒）
+	dailyQuota   int     // 每个服务端每日连接数配额
+	quotaRatio   float64 // 视为接近配额的用量比例
+	quotaAction  string  // 接近配额时的处理方式
+	statsFile    string  // 流量统计文件
+	statsTop     int     // stats 命令每个维度显示的条数
+	apiAddr      string  // 管理 API 监听地址
+	wsCoalesce   int     // 上行写合并等待时间（微秒）
+	wsMaxFrame   int     // 上行单个消息最大长度（KB）
+	wsCompress   string  // permessage-deflate 压缩策略
+	command      string  // 子命令（ech-check）
 )
 
 // func init() {
@@ -40,14 +94,102 @@ func init() {
 	flag.StringVar(&token, "token", "jmrx", "身份验证令牌")
 	flag.StringVar(&listenAddr, "l", "0.0.0.0:30000", "代理监听地址 (支持 SOCKS5 和 HTTP)")
 	flag.StringVar(&serverIP, "ip", "saas.sin.fan", "指定服务端 IP(绕过 DNS 解析)")
-	flag.StringVar(&dnsServer, "dns", "dns.alidns.com/dns-query", "ECH 查询 DoH 服务器")
+	flag.StringVar(&dnsServer, "dns", "dns.alidns.com/dns-query", "ECH 查询 DNS 服务器 (多个用逗号分隔, 支持 https:// tls:// tcp:// udp://)")
 	flag.StringVar(&echDomain, "ech", "cloudflare-ech.com", "ECH 查询域名")
+	flag.StringVar(&echPolicy, "ech-policy", "required", "ECH 策略: required(必须使用 ECH), preferred(ECH 不可用时退回普通 TLS), disabled(不使用 ECH)")
+	flag.StringVar(&configFile, "config", "", "服务端配置文件 (JSON, 可配置多个服务端及各自的 ECH, 指定后忽略 -f -ip -token)")
 	flag.StringVar(&routingMode, "routing", "bypass_cn", "分流模式: global(全局代理), bypass_cn(跳过中国大陆), none(不改变代理)")
-	flag.Parse()
+	flag.StringVar(&redirAddr, "redir", "", "透明代理 REDIRECT 监听地址 (仅 Linux, 如 0.0.0.0:30001)")
+	flag.StringVar(&tproxyAddr, "tproxy", "", "透明代理 TPROXY 监听地址 (仅 Linux, TCP+UDP, 如 0.0.0.0:30002)；UDP 只转发 DNS 与直连目标，需要代理的 UDP (如 QUIC) 会被丢弃")
+	flag.StringVar(&tunName, "tun", "", "TUN 设备名 (仅 Linux, 如 ew0, 为空则不启用)；UDP 只转发 DNS 与直连目标，需要代理的 UDP (如 QUIC) 会被丢弃")
+	flag.StringVar(&tunAddr, "tun-addr", "198.18.0.1/15", "TUN 设备地址 (不能位于 -fake-ip-range 内)")
+	flag.IntVar(&tunMTU, "tun-mtu", 1500, "TUN 设备 MTU")
+	flag.BoolVar(&tunRoute, "tun-auto-route", true, "自动配置策略路由，将默认流量导入 TUN")
+	flag.StringVar(&dnsListen, "dns-listen", "", "内置 DNS 监听地址 (UDP+TCP, 如 0.0.0.0:53, 为空则不启用)")
+	flag.StringVar(&dnsMode, "dns-mode", "redir-host", "内置 DNS 模式: redir-host(真实地址), fake-ip(虚假地址, 按域名分流)")
+	flag.StringVar(&dnsDomestic, "dns-domestic", "dns.alidns.com/dns-query", "国内域名使用的 DNS 服务器 (多个用逗号分隔, 支持 https:// tls:// tcp:// udp://)")
+	flag.StringVar(&fakeIPRange, "fake-ip-range", "198.19.0.0/16", "fake-ip 地址段 (默认位于 TUN 网段内、不含 TUN 设备地址)")
+	flag.IntVar(&dnsCache, "dns-cache", 4096, "DNS 缓存记录数 (0 为不缓存)")
+	flag.IntVar(&dnsMinTTL, "dns-min-ttl", 60, "DNS 缓存最短时间 (秒)")
+	flag.IntVar(&dnsMaxTTL, "dns-max-ttl", 86400, "DNS 缓存最长时间 (秒)")
+	flag.BoolVar(&dohGet, "doh-get", false, "DoH 使用 GET 请求 (默认 POST)")
+	flag.BoolVar(&dohRace, "doh-race", false, "同时查询多个 DoH 服务器，取最快结果 (默认依次回退)")
+	flag.IntVar(&poolMinIdle, "pool-min-idle", 0, "每个服务端预热的最少空闲连接数 (0 为不预热，预热连接会持续占用 Worker 请求与配额)")
+	flag.IntVar(&poolMaxIdle, "pool-max-idle", 8, "每个服务端预热的最多空闲连接数")
+	flag.IntVar(&poolMaxAge, "pool-max-age", 60, "预热连接最长空闲时间 (秒)")
+	flag.IntVar(&poolPing, "pool-ping", 10, "预热连接保活间隔 (秒，需小于 30，超过 30 秒未收到 pong 的连接视为失效)")
+	flag.BoolVar(&earlyData, "early-data", true, "SOCKS5 先回复成功并将客户端首包随连接请求发送，节省一次往返 (需要 v2 隧道协议的 _worker.js，旧版 Worker 退回为连接后发送)")
+	flag.IntVar(&idleTimeout, "idle-timeout", 300, "代理隧道空闲超时，两个方向都没有数据时断开 (秒，0 为不限制)")
+	flag.IntVar(&maxLifetime, "max-lifetime", 0, "代理隧道最长存活时间 (秒，0 为不限制)")
+	flag.IntVar(&handshakeTO, "handshake-timeout", 30, "SOCKS5 / HTTP 请求解析超时 (秒，0 为不限制)")
+	flag.IntVar(&tcpKeepAlive, "tcp-keepalive", 30, "接入连接的 TCP keepalive 间隔 (秒，0 为关闭)")
+	flag.StringVar(&bwGlobal, "bw-global", "", "全局带宽限制，格式: 上行/下行，单位字节/秒，支持 K/M/G (如 2M/10M，空为不限速)")
+	flag.StringVar(&bwClient, "bw-client", "", "每个客户端 IP 的带宽限制，格式同 -bw-global")
+	flag.StringVar(&bwUser, "bw-user", "", "每个认证用户的带宽限制 (同一用户的连接共享，需启用 -auth)，格式同 -bw-global")
+	flag.StringVar(&authUsers, "auth", "", "SOCKS5 / HTTP 代理认证用户，格式: 用户名:密码，多个用逗号分隔 (空为不认证，不影响透明代理与 TUN)")
+	flag.StringVar(&authFile, "auth-file", "", "认证用户文件，每行一个 用户名:密码 (与 -auth 合并)")
+	flag.StringVar(&bwProxy, "bw-proxy", "", "分流到代理的流量带宽限制，格式同 -bw-global")
+	flag.StringVar(&bwDirect, "bw-direct", "", "分流到直连的流量带宽限制，格式同 -bw-global")
+	flag.IntVar(&maxTunnels, "max-tunnels", 0, "全局最大并发代理隧道数 (0 为不限制)")
+	flag.IntVar(&maxClientTun, "max-client-tunnels", 0, "每个客户端 IP 最大并发代理隧道数 (0 为不限制)")
+	flag.Float64Var(&tunnelRate, "tunnel-rate", 0, "全局每秒新建代理隧道数 (0 为不限制)")
+	flag.Float64Var(&clientRate, "client-tunnel-rate", 0, "每个客户端 IP 每秒新建代理隧道数 (0 为不限制)")
+	flag.IntVar(&tunnelQueue, "tunnel-queue", 5, "超出隧道限制时排队等待的最长时间 (秒，0 为立即拒绝)")
+	flag.IntVar(&dailyQuota, "daily-quota", 0, "每个服务端每日 WebSocket 连接数 (Worker 请求数) 配额 (0 为不限制)")
+	flag.Float64Var(&quotaRatio, "quota-threshold", 0.9, "今日连接数达到配额的该比例时视为接近配额")
+	flag.StringVar(&quotaAction, "quota-action", "failover", "所有服务端接近配额时: failover(继续使用), direct(改为直连；注意直连时目标网站与网络中间人可见本机真实 IP 与访问的域名，本应走代理的流量不再受保护)")
+	flag.StringVar(&statsFile, "stats-file", "", "流量统计文件 (如 stats.json)，相对路径位于程序所在目录；空为不保存 (未指定 -api 时也不统计)")
+	flag.IntVar(&statsTop, "stats-top", 10, "stats 命令每个维度显示的条数 (0 为全部)")
+	flag.IntVar(&wsCoalesce, "ws-coalesce", 500, "上行小块数据的合并等待时间 (微秒，0 为不合并)")
+	flag.IntVar(&wsMaxFrame, "ws-max-frame", 64, "上行单个 WebSocket 消息的最大数据长度 (KB)")
+	flag.StringVar(&wsCompress, "ws-compress", "off", "WebSocket 压缩: off(不压缩), auto(只压缩明文目标), all(全部压缩)")
+	flag.StringVar(&apiAddr, "api", "", "管理 API 监听地址 (如 127.0.0.1:30001，空为不启用)；stats 命令通过该地址读取运行中的统计")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "用法: %s [命令] [参数]\n\n命令:\n  ech-check  诊断各服务端的 ECH 配置与握手\n  stats      查看流量统计 (今日与本月)\n\n参数:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	// 第一个参数不以 - 开头时视为子命令，其后为参数
+	args := os.Args[1:]
+	if len(args) != 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args) //nolint:errcheck
+}
+
+// newDNSUpstream 按命令行参数创建直连 DNS 上游（逗号分隔，支持 https:// tls:// tcp:// udp://）
+func newDNSUpstream(servers string) utils.DNSExchanger {
+	upstream, err := utils.NewDNSUpstream(strings.Split(servers, ","), newDoHClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return upstream
+}
+
+// newDoHClient 按命令行参数创建直连 DoH 客户端
+func newDoHClient(servers []string) *utils.DoHClient {
+	client := utils.NewDoHClient(servers, nil)
+	if dohGet {
+		client.Method = http.MethodGet
+	}
+	client.Race = dohRace
+	return client
 }
 
 func main() {
-	if len(serverAddr) == 0 {
+	switch command {
+	case "":
+	case "ech-check":
+		runECHCheck()
+		return
+	case "stats":
+		runStats()
+		return
+	default:
+		log.Fatalf("未知的命令: %s", command)
+	}
+
+	if len(serverAddr) == 0 && len(configFile) == 0 {
 		log.Fatal("必须指定服务端地址 -f\n\n示例:\n  ./ew -l 0.0.0.0:30000 -f your-worker.workers.dev:443 -token your-token")
 		return
 	}
@@ -95,21 +237,196 @@ func safeExit() {
 		if err := utils.RestoreProxyState(); err != nil {
 			log.Printf("[系统] 恢复代理状态失败: %v\n", err)
 		}
+		utils.RunExitHooks()
 		os.Exit(0)
 	}()
 }
 
+// loadServers 按命令行参数或配置文件创建服务端列表
+func loadServers() []*worker.ProxyClientConfig {
+	servers := []worker.ServerConfig{{
+		Addr:  serverAddr,
+		IP:    serverIP,
+		Token: token,
+	}}
+	if len(configFile) != 0 {
+		var err error
+		if servers, err = worker.LoadServerConfigs(configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	policy, err := worker.ParseECHPolicy(echPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configs, err := worker.NewProxyClientConfigs(servers, newDNSUpstream(dnsServer), echDomain, policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return configs
+}
+
+// runECHCheck 诊断各服务端的 ECH，任一服务端未能使用 ECH 时以非零状态退出
+func runECHCheck() {
+	failed := false
+	for _, server := range loadServers() {
+		if err := worker.CheckECH(server, os.Stdout); err != nil {
+			failed = true
+		}
+		fmt.Println()
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// resolveStatsFile 统计文件的完整路径，相对路径位于程序所在目录
+func resolveStatsFile() string {
+	if len(statsFile) == 0 || filepath.IsAbs(statsFile) {
+		return statsFile
+	}
+	path, err := utils.ExeFilePath(statsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return path
+}
+
+// runStats 打印今日与本月的流量统计：指定 -api 时读取运行中的代理，否则读取统计文件
+func runStats() {
+	var stats worker.UsageStats
+	var err error
+	switch {
+	case len(apiAddr) != 0:
+		stats, err = worker.FetchUsageStats(apiAddr)
+	case len(statsFile) != 0:
+		stats, err = worker.LoadUsageStats(resolveStatsFile())
+	default:
+		err = errors.New("需要指定 -api 或 -stats-file")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now()
+	day, month := now.Format(time.DateOnly), now.Format("2006-01")
+	worker.PrintUsage(os.Stdout, "今日 "+day, stats.Daily[day], statsTop)
+	worker.PrintUsage(os.Stdout, "本月 "+month, stats.Monthly[month], statsTop)
+}
+
+// loadUserAuth 合并 -auth 与 -auth-file 中的用户，格式错误时退出
+func loadUserAuth() worker.UserAuth {
+	auth, err := worker.ParseUserAuth(authUsers)
+	if err != nil {
+		log.Fatalf("[启动] -auth: %v", err)
+	}
+	if len(authFile) == 0 {
+		return auth
+	}
+	fileAuth, err := worker.LoadUserAuth(authFile)
+	if err != nil {
+		log.Fatalf("[启动] -auth-file: %v", err)
+	}
+	if auth == nil {
+		return fileAuth
+	}
+	for user, pass := range fileAuth {
+		auth[user] = pass
+	}
+	return auth
+}
+
+// parseBandwidthFlag 解析带宽限制参数，格式错误时退出
+func parseBandwidthFlag(name, value string) worker.BandwidthLimit {
+	limit, err := worker.ParseBandwidthLimit(value)
+	if err != nil {
+		log.Fatalf("[启动] -%s: %v", name, err)
+	}
+	return limit
+}
+
 // run 启动代理
 func run() {
-	config := &worker.ProxyClientConfig{
-		ServerAddr: serverAddr,
-		ServerIP:   serverIP,
-		Token:      token,
-	}
+	configs := loadServers()
 	ipLoader := worker.NewIPLoader(routingMode)
-	ech := worker.NewEch(dnsServer, echDomain)
-	proxyServer := worker.NewProxyServer(listenAddr, config, ipLoader, ech)
+	proxyServer := worker.NewProxyServer(listenAddr, configs, ipLoader)
+	proxyServer.Auth = loadUserAuth()
+	proxyServer.RedirAddr = redirAddr
+	proxyServer.TProxyAddr = tproxyAddr
+	proxyServer.Tun = &worker.TunConfig{
+		Name:      tunName,
+		Addr:      tunAddr,
+		MTU:       tunMTU,
+		AutoRoute: tunRoute,
+	}
+	proxyServer.DNS = &worker.DNSConfig{
+		Listen:      dnsListen,
+		Mode:        dnsMode,
+		Domestic:    newDNSUpstream(dnsDomestic),
+		FakeIPRange: fakeIPRange,
+		CacheSize:   dnsCache,
+		MinTTL:      time.Duration(dnsMinTTL) * time.Second,
+		MaxTTL:      time.Duration(dnsMaxTTL) * time.Second,
+	}
+	proxyServer.EarlyData = earlyData
+	proxyServer.Timeouts = worker.TimeoutConfig{
+		Idle:        time.Duration(idleTimeout) * time.Second,
+		MaxLifetime: time.Duration(maxLifetime) * time.Second,
+		Handshake:   time.Duration(handshakeTO) * time.Second,
+		KeepAlive:   time.Duration(tcpKeepAlive) * time.Second,
+	}
+	proxyServer.Bandwidth = worker.BandwidthConfig{
+		Global: parseBandwidthFlag("bw-global", bwGlobal),
+		Client: parseBandwidthFlag("bw-client", bwClient),
+		User:   parseBandwidthFlag("bw-user", bwUser),
+		Proxy:  parseBandwidthFlag("bw-proxy", bwProxy),
+		Direct: parseBandwidthFlag("bw-direct", bwDirect),
+	}
+	proxyServer.ConnLimit = worker.ConnLimitConfig{
+		MaxTunnels:       maxTunnels,
+		MaxClientTunnels: maxClientTun,
+		Rate:             tunnelRate,
+		ClientRate:       clientRate,
+		QueueTimeout:     time.Duration(tunnelQueue) * time.Second,
+	}
+	action, err := worker.ParseQuotaAction(quotaAction)
+	if err != nil {
+		log.Fatalf("[启动] %v", err)
+	}
+	proxyServer.Quota = worker.QuotaConfig{
+		Daily:     dailyQuota,
+		Threshold: quotaRatio,
+		Action:    action,
+	}
+	compress, err := worker.ParseCompressionMode(wsCompress)
+	if err != nil {
+		log.Fatalf("[启动] %v", err)
+	}
+	proxyServer.Compress = compress
+	proxyServer.Coalesce = worker.CoalesceConfig{
+		Window:   time.Duration(wsCoalesce) * time.Microsecond,
+		MaxFrame: wsMaxFrame * 1024,
+	}
+	proxyServer.StatsFile = resolveStatsFile()
+	proxyServer.APIAddr = apiAddr
+	proxyServer.Pool = worker.WSPoolConfig{
+		MinIdle:      poolMinIdle,
+		MaxIdle:      poolMaxIdle,
+		MaxAge:       time.Duration(poolMaxAge) * time.Second,
+		PingInterval: time.Duration(poolPing) * time.Second,
+	}
 	if err := proxyServer.Run(); err != nil {
-		log.Fatal(err)
+		exitOnError(err)
+	}
+}
+
+// exitOnError 启动失败时恢复系统代理、执行善后函数（如清理 TUN 路由）后退出
+//
+// 直接写标准错误：日志是异步输出的，随后退出时可能来不及打印
+func exitOnError(err error) {
+	fmt.Fprintf(os.Stderr, "[启动] %v\n", err)
+	if err := utils.RestoreProxyState(); err != nil {
+		fmt.Fprintf(os.Stderr, "[系统] 恢复代理状态失败: %v\n", err)
 	}
+	utils.RunExitHooks()
+	os.Exit(1)
 }
@@ -2,8 +2,22 @@ const WS_READY_STATE_OPEN = 1;
 const WS_READY_STATE_CLOSING = 2;
 const CF_FALLBACK_IPS = ['ProxyIP.CMLiussss.net'];// cm维护
 
-// 复用 TextEncoder，避免重复创建
+// 隧道协议版本：客户端在请求头中声明支持的最高版本，服务端在响应头中返回选用的版本
+// v1: 文本控制帧 CONNECT:host:port|payload；v2: 二进制控制帧（每个消息以 1 字节帧类型开头）
+const TUNNEL_VERSION_HEADER = 'X-Tunnel-Version';
+const FRAME_DATA = 0x00;      // type | data
+const FRAME_CONNECT = 0x01;   // type | atyp | addr | port(2) | payload_len(4) | payload | TLV...
+const FRAME_CONNECTED = 0x02; // type | TLV...
+const FRAME_ERROR = 0x03;     // type | msg_len(2) | msg | TLV...
+const FRAME_CLOSE = 0x04;     // type（中止连接）
+const FRAME_FIN = 0x05;       // type（发送方不再发送数据，半关闭）
+const META_REQUEST_ID = 0x01; // 请求 ID，在 CONNECTED / ERROR 中原样返回
+const META_PROTOCOL = 0x02;   // 请求的协议：1 TCP，2 UDP
+const PROTOCOL_TCP = 0x01;
+
+// 复用 TextEncoder/TextDecoder，避免重复创建
 const encoder = new TextEncoder();
+const decoder = new TextDecoder();
 
 import { connect } from 'cloudflare:sockets';
 
@@ -23,20 +37,27 @@ export default {
         return new Response('Unauthorized', { status: 401 });
       }
 
+      const version = parseInt(request.headers.get(TUNNEL_VERSION_HEADER), 10) >= 2 ? 2 : 1;
+
       const [client, server] = Object.values(new WebSocketPair());
       server.accept();
 
-      handleSession(server).catch(() => safeCloseWebSocket(server));
+      handleSession(server, version).catch(() => safeCloseWebSocket(server));
+
+      const headers = {};
+      if (token) {
+        headers['Sec-WebSocket-Protocol'] = token;
+      }
+      if (version === 2) {
+        headers[TUNNEL_VERSION_HEADER] = '2';
+      }
 
       const responseInit = {
         status: 101,
-        webSocket: client
+        webSocket: client,
+        headers
       };
 
-      if (token) {
-        responseInit.headers = { 'Sec-WebSocket-Protocol': token };
-      }
-
       return new Response(null, responseInit);
 
     } catch (err) {
@@ -45,9 +66,62 @@ export default {
   },
 };
 
-async function handleSession(webSocket) {
+async function handleSession(webSocket, version) {
   let remoteSocket, remoteWriter, remoteReader;
   let isClosed = false;
+  let requestID = null; // v2 CONNECT 的请求 ID（原始字节）
+  let localFin = false;  // v2：客户端已半关闭（不再发送数据）
+  let remoteFin = false; // v2：远端已半关闭
+
+  // v2：发送控制帧，附带请求 ID
+  const sendFrame = (type, body = new Uint8Array(0)) => {
+    const meta = requestID ? 3 + requestID.byteLength : 0;
+    const frame = new Uint8Array(1 + body.byteLength + meta);
+    frame[0] = type;
+    frame.set(body, 1);
+    if (requestID) {
+      const offset = 1 + body.byteLength;
+      frame[offset] = META_REQUEST_ID;
+      new DataView(frame.buffer).setUint16(offset + 1, requestID.byteLength);
+      frame.set(requestID, offset + 3);
+    }
+    webSocket.send(frame);
+  };
+
+  const sendConnected = () => {
+    if (version === 2) sendFrame(FRAME_CONNECTED);
+    else webSocket.send('CONNECTED');
+  };
+
+  const sendError = (message) => {
+    if (version === 2) {
+      const msg = encoder.encode(message);
+      const body = new Uint8Array(2 + msg.byteLength);
+      new DataView(body.buffer).setUint16(0, msg.byteLength);
+      body.set(msg, 2);
+      sendFrame(FRAME_ERROR, body);
+    } else {
+      webSocket.send('ERROR:' + message);
+    }
+  };
+
+  const sendClose = () => {
+    if (version === 2) webSocket.send(new Uint8Array([FRAME_CLOSE]));
+    else webSocket.send('CLOSE');
+  };
+
+  const sendFin = () => webSocket.send(new Uint8Array([FRAME_FIN]));
+
+  const sendData = (value) => {
+    if (version === 2) {
+      const frame = new Uint8Array(1 + value.byteLength);
+      frame[0] = FRAME_DATA;
+      frame.set(value, 1);
+      webSocket.send(frame);
+    } else {
+      webSocket.send(value);
+    }
+  };
 
   const cleanup = () => {
     if (isClosed) return;
@@ -66,14 +140,23 @@ async function handleSession(webSocket) {
       while (!isClosed && remoteReader) {
         const { done, value } = await remoteReader.read();
 
-        if (done) break;
+        if (done) {
+          // v2：远端正常结束时只通知客户端半关闭，两个方向都结束后再关闭
+          if (version === 2 && !isClosed) {
+            remoteFin = true;
+            sendFin();
+            if (localFin) cleanup();
+            return;
+          }
+          break;
+        }
         if (webSocket.readyState !== WS_READY_STATE_OPEN) break;
-        if (value?.byteLength > 0) webSocket.send(value);
+        if (value?.byteLength > 0) sendData(value);
       }
     } catch { }
 
     if (!isClosed) {
-      try { webSocket.send('CLOSE'); } catch { }
+      try { sendClose(); } catch { }
       cleanup();
     }
   };
@@ -93,6 +176,58 @@ async function handleSession(webSocket) {
     };
   };
 
+  // v2：解析 CONNECT 帧，返回 { host, port, payload, meta }
+  const parseConnectFrame = (frame) => {
+    const view = new DataView(frame.buffer, frame.byteOffset, frame.byteLength);
+    let offset = 1;
+    const need = (n) => {
+      if (offset + n > frame.byteLength) throw new Error('隧道帧格式错误');
+    };
+
+    need(1);
+    const atyp = frame[offset++];
+    let host;
+    if (atyp === 0x01) {
+      need(4);
+      host = Array.from(frame.subarray(offset, offset + 4)).join('.');
+      offset += 4;
+    } else if (atyp === 0x03) {
+      need(1);
+      const len = frame[offset++];
+      need(len);
+      host = decoder.decode(frame.subarray(offset, offset + len));
+      offset += len;
+    } else if (atyp === 0x04) {
+      need(16);
+      const parts = [];
+      for (let i = 0; i < 8; i++) parts.push(view.getUint16(offset + i * 2).toString(16));
+      host = parts.join(':');
+      offset += 16;
+    } else {
+      throw new Error('不支持的地址类型: ' + atyp);
+    }
+
+    need(6);
+    const port = view.getUint16(offset);
+    const payloadLen = view.getUint32(offset + 2);
+    offset += 6;
+    need(payloadLen);
+    const payload = frame.subarray(offset, offset + payloadLen);
+    offset += payloadLen;
+
+    const meta = new Map();
+    while (offset < frame.byteLength) {
+      need(3);
+      const type = frame[offset];
+      const len = view.getUint16(offset + 1);
+      offset += 3;
+      need(len);
+      meta.set(type, frame.subarray(offset, offset + len));
+      offset += len;
+    }
+    return { host, port, payload, meta };
+  };
+
   const isCFError = (err) => {
     const msg = err?.message?.toLowerCase() || '';
     return msg.includes('proxy request') ||
@@ -100,9 +235,8 @@ async function handleSession(webSocket) {
       msg.includes('cloudflare');
   };
 
-  const connectToRemote = async (targetAddr, firstFrameData) => {
-    const { host, port } = parseAddress(targetAddr);
-
+  // firstFrameData 为首帧数据（Uint8Array，可为空）
+  const connectToRemote = async (host, port, firstFrameData) => {
     // 使用 connect API
     const attempts = [null, ...CF_FALLBACK_IPS];
 
@@ -112,10 +246,11 @@ async function handleSession(webSocket) {
         // 如果是域名，需要先解析
         let connectHost = attempts[i] || host;
 
+        // v2 支持半关闭：远端结束读取后仍可继续写入，关闭写入时只发送 FIN
         remoteSocket = connect({
           hostname: connectHost,
           port
-        });
+        }, { allowHalfOpen: version === 2 });
 
         if (remoteSocket.opened) await remoteSocket.opened;
 
@@ -123,17 +258,11 @@ async function handleSession(webSocket) {
         remoteReader = remoteSocket.readable.getReader();
 
         // 发送首帧数据（如果有）
-        if (firstFrameData && firstFrameData.length > 0) {
-          // 检查是否是 Base64 编码（SOCKS5 二进制数据）
-          let dataToSend = firstFrameData;
-          if (firstFrameData.startsWith('base64:')) {
-            // Base64 解码
-            dataToSend = atob(firstFrameData.substring(7));
-          }
-          await remoteWriter.write(encoder.encode(dataToSend));
+        if (firstFrameData?.byteLength > 0) {
+          await remoteWriter.write(firstFrameData);
         }
 
-        webSocket.send('CONNECTED');
+        sendConnected();
         pumpRemoteToWebSocket();
         return;
 
@@ -152,19 +281,62 @@ async function handleSession(webSocket) {
     }
   };
 
+  // v1 首帧：base64: 前缀为二进制数据（SOCKS5，如 TLS ClientHello），否则为文本
+  // atob 返回二进制字符串，需按字节还原，不能再经 UTF-8 编码
+  const decodeFirstFrame = (firstFrame) => firstFrame.startsWith('base64:')
+    ? Uint8Array.from(atob(firstFrame.substring(7)), c => c.charCodeAt(0))
+    : encoder.encode(firstFrame);
+
+  const handleFrame = async (frame) => {
+    switch (frame[0]) {
+      case FRAME_DATA:
+        if (remoteWriter && frame.byteLength > 1) {
+          await remoteWriter.write(frame.subarray(1));
+        }
+        break;
+      case FRAME_CONNECT: {
+        const { host, port, payload, meta } = parseConnectFrame(frame);
+        requestID = meta.get(META_REQUEST_ID) || null;
+        const protocol = meta.get(META_PROTOCOL);
+        if (protocol && protocol[0] !== PROTOCOL_TCP) {
+          throw new Error('不支持的协议: ' + protocol[0]);
+        }
+        await connectToRemote(host, port, payload);
+        break;
+      }
+      case FRAME_FIN:
+        localFin = true;
+        if (remoteFin) {
+          cleanup();
+        } else {
+          await remoteWriter?.close();
+        }
+        break;
+      case FRAME_CLOSE:
+        cleanup();
+        break;
+      default:
+        throw new Error('未知的隧道帧: ' + frame[0]);
+    }
+  };
+
   webSocket.addEventListener('message', async (event) => {
     if (isClosed) return;
 
     try {
       const data = event.data;
 
-      if (typeof data === 'string') {
+      if (version === 2) {
+        if (!(data instanceof ArrayBuffer) || data.byteLength === 0) {
+          throw new Error('隧道帧格式错误');
+        }
+        await handleFrame(new Uint8Array(data));
+      }
+      else if (typeof data === 'string') {
         if (data.startsWith('CONNECT:')) {
           const sep = data.indexOf('|', 8);
-          await connectToRemote(
-            data.substring(8, sep),
-            data.substring(sep + 1)
-          );
+          const { host, port } = parseAddress(data.substring(8, sep));
+          await connectToRemote(host, port, decodeFirstFrame(data.substring(sep + 1)));
         }
         else if (data.startsWith('DATA:')) {
           if (remoteWriter) {
@@ -179,7 +351,7 @@ async function handleSession(webSocket) {
         await remoteWriter.write(new Uint8Array(data));
       }
     } catch (err) {
-      try { webSocket.send('ERROR:' + err.message); } catch { }
+      try { sendError(err.message); } catch { }
       cleanup();
     }
   });
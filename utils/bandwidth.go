@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter 字节限速器组（如全局、客户端、分流规则各一个），全部放行才继续；nil 为不限速
+type Limiter []*rate.Limiter
+
+// Throttle 一条连接的上行（客户端 -> 远端）与下行限速
+type Throttle struct {
+	Up   Limiter
+	Down Limiter
+}
+
+// NewRateLimiter 创建每秒 bytesPerSec 字节的令牌桶，突发为 1 秒的流量；bytesPerSec 为 0 时返回 nil
+func NewRateLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(min(bytesPerSec, 1<<30)))
+}
+
+// Wait 等待 n 字节的令牌，超过突发量时分段等待；ctx 取消时返回错误
+func (l Limiter) Wait(ctx context.Context, n int) error {
+	for _, limiter := range l {
+		if limiter == nil {
+			continue
+		}
+		for remaining := n; remaining > 0; {
+			chunk := min(remaining, limiter.Burst())
+			if err := limiter.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+			remaining -= chunk
+		}
+	}
+	return nil
+}
+
+// Unlimited 是否不限速
+func (l Limiter) Unlimited() bool {
+	for _, limiter := range l {
+		if limiter != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Reader 返回按限速读取的 Reader，不限速时原样返回
+func (l Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l.Unlimited() {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.Wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// ParseBandwidth 解析带宽，单位为字节/秒，支持 K、M、G 后缀（1024 进制），0 或空为不限速
+func ParseBandwidth(str string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(str))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/S"), "B")
+	if len(s) == 0 {
+		return 0, nil
+	}
+	unit := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		unit = 1 << 10
+	case 'M':
+		unit = 1 << 20
+	case 'G':
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("无效的带宽: %s", str)
+	}
+	return int64(value * float64(unit)), nil
+}
@@ -1,10 +1,9 @@
 package utils
 
-const typeHTTPS = 65
-
 // 代理模式常量
 const (
 	ModeSOCKS5      = 1 // SOCKS5 代理
 	ModeHTTPConnect = 2 // HTTP CONNECT 隧道
 	ModeHTTPProxy   = 3 // HTTP 普通代理（GET/POST等）
+	ModeTransparent = 4 // 透明代理（REDIRECT/TPROXY），客户端无握手，无需响应
 )
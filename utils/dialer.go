@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// outboundMark 出站套接字的 fwmark（TUN 模式下用于避免流量回环），0 表示不设置
+var outboundMark atomic.Int32
+
+// SetOutboundMark 设置出站连接的 fwmark，并让 Go 内置解析器也使用带标记的连接
+//
+// 会替换 net.DefaultResolver 的拨号函数，须在发起任何出站连接之前调用
+func SetOutboundMark(mark int) {
+	outboundMark.Store(int32(mark))
+	net.DefaultResolver.PreferGo = true
+	net.DefaultResolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return NewDialer(5*time.Second).DialContext(ctx, network, address)
+	}
+}
+
+// NewDialer 创建出站 Dialer，所有主动发起的连接（直连、WebSocket、DoH）都应使用它
+func NewDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   outboundControl,
+	}
+}
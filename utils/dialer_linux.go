@@ -0,0 +1,20 @@
+//go:build linux
+
+package utils
+
+import "syscall"
+
+func outboundControl(network, address string, c syscall.RawConn) error {
+	mark := int(outboundMark.Load())
+	if mark == 0 {
+		return nil
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package utils
+
+import "syscall"
+
+func outboundControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
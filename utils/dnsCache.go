@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newde36524/ew/utils/log"
+)
+
+const (
+	dnsNegativeMaxTTL  = 10 * time.Minute // 否定应答最长缓存时间
+	dnsStaleWindow     = time.Hour        // 过期后仍可在上游失败时使用的时长（RFC 8767）
+	dnsStaleTTL        = 30               // 过期应答返回给客户端的 TTL（秒）
+	dnsPrefetchHits    = 3                // 命中次数达到该值的记录才会预取
+	dnsPrefetchPercent = 10               // 剩余有效期低于原 TTL 的该百分比时预取
+)
+
+// DNSCache DNS 应答缓存，按 名称/类型/类别 索引
+//
+// 正常应答按应答段最小 TTL 缓存（受 minTTL/maxTTL 限制），
+// NXDOMAIN 与空应答按 SOA 缓存（RFC 2308），上游失败时返回过期记录，
+// 热门记录在即将过期时后台预取
+type DNSCache struct {
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+	size    int
+	minTTL  time.Duration
+	maxTTL  time.Duration
+}
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type dnsCacheEntry struct {
+	msg         *DNSMessage
+	ttl         time.Duration
+	expireAt    time.Time
+	hits        int
+	prefetching bool
+}
+
+// NewDNSCache 创建 DNS 缓存，size 为最大记录数
+func NewDNSCache(size int, minTTL, maxTTL time.Duration) *DNSCache {
+	if maxTTL < minTTL {
+		maxTTL = minTTL
+	}
+	return &DNSCache{
+		entries: make(map[dnsCacheKey]*dnsCacheEntry),
+		size:    size,
+		minTTL:  minTTL,
+		maxTTL:  maxTTL,
+	}
+}
+
+// Exchange 优先从缓存应答查询，未命中时调用 upstream 并缓存结果。c 为 nil 时直接查询上游
+func (c *DNSCache) Exchange(query []byte, upstream func([]byte) ([]byte, error)) ([]byte, error) {
+	if c == nil {
+		return upstream(query)
+	}
+	msg, err := ParseDNSMessage(query)
+	if err != nil {
+		return upstream(query)
+	}
+	question, ok := msg.Question()
+	if !ok || len(msg.Questions) != 1 {
+		return upstream(query)
+	}
+	key := dnsCacheKey{name: strings.ToLower(question.Name), qtype: question.Type, qclass: question.Class}
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && now.Before(entry.expireAt) {
+		entry.hits++
+		remaining := entry.expireAt.Sub(now)
+		cached := entry.msg
+		prefetch := !entry.prefetching && entry.hits >= dnsPrefetchHits &&
+			remaining*100 < entry.ttl*dnsPrefetchPercent
+		if prefetch {
+			entry.prefetching = true
+		}
+		c.mu.Unlock()
+
+		if prefetch {
+			go c.prefetch(key, append([]byte(nil), query...), upstream)
+		}
+		return packCachedReply(cached, msg.ID, uint32((remaining+time.Second-1)/time.Second))
+	}
+	c.mu.Unlock()
+
+	resp, err := upstream(query)
+	if err != nil {
+		// 上游失败时返回过期不久的记录
+		if ok && now.Before(entry.expireAt.Add(dnsStaleWindow)) {
+			log.Printf("[DNS] 上游查询失败，使用过期缓存: %s (%v)", question.Name, err)
+			return packCachedReply(entry.msg, msg.ID, dnsStaleTTL)
+		}
+		return nil, err
+	}
+	c.store(key, resp)
+	return resp, nil
+}
+
+// prefetch 在记录过期前刷新缓存
+func (c *DNSCache) prefetch(key dnsCacheKey, query []byte, upstream func([]byte) ([]byte, error)) {
+	resp, err := upstream(query)
+	if err == nil && c.store(key, resp) {
+		return
+	}
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		entry.prefetching = false
+	}
+	c.mu.Unlock()
+}
+
+// store 缓存上游应答，返回是否已缓存
+func (c *DNSCache) store(key dnsCacheKey, resp []byte) bool {
+	msg, err := ParseDNSMessage(resp)
+	if err != nil || !msg.Response || msg.Truncated {
+		return false
+	}
+	question, ok := msg.Question()
+	if !ok || strings.ToLower(question.Name) != key.name || question.Type != key.qtype || question.Class != key.qclass {
+		return false
+	}
+	ttl, ok := c.cacheTTL(msg)
+	if !ok {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hits := 0
+	if old, ok := c.entries[key]; ok {
+		hits = old.hits
+	} else if len(c.entries) >= c.size {
+		c.evictLocked()
+	}
+	c.entries[key] = &dnsCacheEntry{
+		msg:      msg,
+		ttl:      ttl,
+		expireAt: time.Now().Add(ttl),
+		hits:     hits,
+	}
+	return true
+}
+
+// cacheTTL 计算应答的缓存时间
+func (c *DNSCache) cacheTTL(msg *DNSMessage) (time.Duration, bool) {
+	var ttl time.Duration
+	switch {
+	case msg.RCode == RCodeSuccess && len(msg.Answers) != 0:
+		minTTL, _ := msg.MinTTL()
+		ttl = min(max(time.Duration(minTTL)*time.Second, c.minTTL), c.maxTTL)
+	case msg.RCode == RCodeSuccess || msg.RCode == RCodeNameError:
+		// 否定应答没有 SOA 时不缓存
+		negTTL, ok := msg.NegativeTTL()
+		if !ok {
+			return 0, false
+		}
+		ttl = min(max(time.Duration(negTTL)*time.Second, c.minTTL), c.maxTTL, dnsNegativeMaxTTL)
+	default:
+		return 0, false
+	}
+	return ttl, ttl > 0
+}
+
+// evictLocked 淘汰已超出过期窗口的记录，仍然已满时再随机淘汰一条
+func (c *DNSCache) evictLocked() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expireAt.Add(dnsStaleWindow)) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// packCachedReply 以查询 ID 与剩余 TTL 重新打包缓存的应答
+func packCachedReply(cached *DNSMessage, id uint16, ttl uint32) ([]byte, error) {
+	reply := *cached
+	reply.ID = id
+	reply.Answers = withTTL(cached.Answers, ttl)
+	reply.Authorities = withTTL(cached.Authorities, ttl)
+	reply.Additionals = withTTL(cached.Additionals, ttl)
+	return reply.Pack()
+}
+
+func withTTL(records []DNSRecord, ttl uint32) []DNSRecord {
+	if len(records) == 0 {
+		return nil
+	}
+	out := make([]DNSRecord, len(records))
+	for i, rr := range records {
+		out[i] = rr
+		// OPT 记录的 TTL 字段是标志位，保持不变
+		if rr.Type != TypeOPT {
+			out[i].TTL = ttl
+		}
+	}
+	return out
+}
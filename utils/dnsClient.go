@@ -0,0 +1,250 @@
+//nolint:errcheck
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	dnsQueryTimeout = 5 * time.Second
+	dnsIdleConns    = 2 // DoT/TCP 保留的空闲连接数
+)
+
+// DNSExchanger 发送原始 DNS 报文并返回原始响应
+type DNSExchanger interface {
+	Exchange(query []byte) ([]byte, error)
+}
+
+// NewDNSUpstream 按地址列表创建上游，支持以下格式：
+//
+//	https://host/path（或不带协议）  DNS over HTTPS
+//	tls://host[:853]                DNS over TLS
+//	tcp://host[:53]                 DNS over TCP
+//	udp://host[:53]                 DNS over UDP（应答截断时改用 TCP）
+//
+// 所有 DoH 地址合并为一个 DoHClient，多种协议混用时依次回退
+func NewDNSUpstream(servers []string, doh func(servers []string) *DoHClient) (DNSExchanger, error) {
+	var upstreams []DNSExchanger
+	var dohServers []string
+	for _, server := range servers {
+		if server = strings.TrimSpace(server); len(server) == 0 {
+			continue
+		}
+		scheme, _, ok := strings.Cut(server, "://")
+		if !ok {
+			scheme = "https"
+		}
+		switch strings.ToLower(scheme) {
+		case "https", "http":
+			if len(dohServers) == 0 {
+				upstreams = append(upstreams, nil) // DoH 客户端的位置，稍后填充
+			}
+			dohServers = append(dohServers, server)
+		case "tls":
+			addr, host, err := parseDNSServerAddr(server, "853")
+			if err != nil {
+				return nil, err
+			}
+			upstreams = append(upstreams, NewStreamDNSClient(addr, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}))
+		case "tcp":
+			addr, _, err := parseDNSServerAddr(server, "53")
+			if err != nil {
+				return nil, err
+			}
+			upstreams = append(upstreams, NewStreamDNSClient(addr, nil))
+		case "udp":
+			addr, _, err := parseDNSServerAddr(server, "53")
+			if err != nil {
+				return nil, err
+			}
+			upstreams = append(upstreams, NewUDPDNSClient(addr))
+		default:
+			return nil, fmt.Errorf("不支持的 DNS 协议: %s", server)
+		}
+	}
+	for i, upstream := range upstreams {
+		if upstream == nil {
+			upstreams[i] = doh(dohServers)
+		}
+	}
+
+	switch len(upstreams) {
+	case 0:
+		return nil, errors.New("未配置 DNS 服务器")
+	case 1:
+		return upstreams[0], nil
+	}
+	return dnsFallback(upstreams), nil
+}
+
+// parseDNSServerAddr 解析 scheme://host[:port]，返回带端口的地址与主机名
+func parseDNSServerAddr(server, defaultPort string) (addr, host string, err error) {
+	u, err := url.Parse(server)
+	if err != nil || len(u.Hostname()) == 0 {
+		return "", "", fmt.Errorf("无效的 DNS 服务器地址: %s", server)
+	}
+	port := u.Port()
+	if len(port) == 0 {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port), u.Hostname(), nil
+}
+
+// dnsFallback 依次尝试多个上游
+type dnsFallback []DNSExchanger
+
+func (f dnsFallback) Exchange(query []byte) ([]byte, error) {
+	var lastErr error
+	for _, upstream := range f {
+		resp, err := upstream.Exchange(query)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// UDPDNSClient 明文 UDP DNS 客户端
+type UDPDNSClient struct {
+	addr string
+	tcp  *StreamDNSClient
+}
+
+func NewUDPDNSClient(addr string) *UDPDNSClient {
+	return &UDPDNSClient{addr: addr, tcp: NewStreamDNSClient(addr, nil)}
+}
+
+func (c *UDPDNSClient) Exchange(query []byte) ([]byte, error) {
+	if len(query) < dnsHeaderLen {
+		return nil, errDNSTruncated
+	}
+	conn, err := NewDialer(dnsQueryTimeout).Dial("udp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("DNS 连接失败: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+
+	// 明文查询使用随机 ID，降低被伪造应答的风险
+	wire, id := withRandomID(query)
+	if _, err := conn.Write(wire); err != nil {
+		return nil, fmt.Errorf("DNS 发送失败: %w", err)
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("DNS 读取失败: %w", err)
+		}
+		if n < dnsHeaderLen || binary.BigEndian.Uint16(buf) != id {
+			continue // 丢弃不匹配的应答
+		}
+		// TC 位：应答被截断，改用 TCP 重新查询
+		if buf[2]&0x02 != 0 {
+			return c.tcp.Exchange(query)
+		}
+		resp := append([]byte(nil), buf[:n]...)
+		copy(resp, query[:2])
+		return resp, nil
+	}
+}
+
+// StreamDNSClient TCP / TLS（DoT）DNS 客户端，报文带 2 字节长度前缀，保留少量空闲连接复用
+type StreamDNSClient struct {
+	addr      string
+	tlsConfig *tls.Config // 为 nil 时使用明文 TCP
+	idle      chan net.Conn
+}
+
+func NewStreamDNSClient(addr string, tlsConfig *tls.Config) *StreamDNSClient {
+	return &StreamDNSClient{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		idle:      make(chan net.Conn, dnsIdleConns),
+	}
+}
+
+func (c *StreamDNSClient) Exchange(query []byte) ([]byte, error) {
+	if len(query) < dnsHeaderLen {
+		return nil, errDNSTruncated
+	}
+	// 复用的连接可能已被服务器关闭，失败后使用新连接重试一次
+	select {
+	case conn := <-c.idle:
+		if resp, err := c.exchange(conn, query); err == nil {
+			return resp, nil
+		}
+	default:
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(conn, query)
+}
+
+func (c *StreamDNSClient) dial() (net.Conn, error) {
+	dialer := NewDialer(dnsQueryTimeout)
+	if c.tlsConfig == nil {
+		conn, err := dialer.Dial("tcp", c.addr)
+		if err != nil {
+			return nil, fmt.Errorf("DNS 连接失败: %w", err)
+		}
+		return conn, nil
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", c.addr, c.tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("DoT 连接失败: %w", err)
+	}
+	return conn, nil
+}
+
+// exchange 在连接上完成一次查询，成功后将连接放回空闲池
+func (c *StreamDNSClient) exchange(conn net.Conn, query []byte) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	wire, id := withRandomID(query)
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(wire))), wire...)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("DNS 发送失败: %w", err)
+	}
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("DNS 读取失败: %w", err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("DNS 读取失败: %w", err)
+	}
+	if len(resp) < dnsHeaderLen || binary.BigEndian.Uint16(resp) != id {
+		conn.Close()
+		return nil, errors.New("DNS 应答 ID 不匹配")
+	}
+
+	conn.SetDeadline(time.Time{})
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	copy(resp, query[:2])
+	return resp, nil
+}
+
+// withRandomID 复制查询报文并替换为随机 ID
+func withRandomID(query []byte) ([]byte, uint16) {
+	wire := append([]byte(nil), query...)
+	rand.Read(wire[:2])
+	return wire, binary.BigEndian.Uint16(wire)
+}
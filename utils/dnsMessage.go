@@ -0,0 +1,750 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNS 记录类型
+const (
+	TypeA     = 1
+	TypeNS    = 2
+	TypeCNAME = 5
+	TypeSOA   = 6
+	TypePTR   = 12
+	TypeTXT   = 16
+	TypeAAAA  = 28
+	TypeOPT   = 41
+	TypeSVCB  = 64
+	TypeHTTPS = 65
+)
+
+// DNS 类别与响应码
+const (
+	ClassINET = 1
+
+	RCodeSuccess       = 0
+	RCodeFormatError   = 1
+	RCodeServerFailure = 2
+	RCodeNameError     = 3
+)
+
+// SvcParamKey（RFC 9460）
+const (
+	SvcParamMandatory = 0
+	SvcParamALPN      = 1
+	SvcParamPort      = 3
+	SvcParamIPv4Hint  = 4
+	SvcParamECH       = 5
+	SvcParamIPv6Hint  = 6
+)
+
+const (
+	dnsHeaderLen  = 12
+	maxDNSNameLen = 255
+	maxDNSLabel   = 63
+	maxPointer    = 0x3FFF
+	ednsUDPSize   = 1232 // 推荐的 EDNS0 UDP 载荷大小（避免 IP 分片）
+)
+
+var (
+	errDNSTruncated = errors.New("DNS 报文不完整")
+	errDNSBadName   = errors.New("DNS 域名格式错误")
+)
+
+// DNSMessage 完整的 DNS 报文（RFC 1035）
+type DNSMessage struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	AuthenticData      bool
+	CheckingDisabled   bool
+	RCode              uint8
+
+	Questions   []DNSQuestion
+	Answers     []DNSRecord
+	Authorities []DNSRecord
+	Additionals []DNSRecord
+}
+
+// DNSQuestion 问题段
+type DNSQuestion struct {
+	Name  string // 不含末尾的点，根域为空字符串
+	Type  uint16
+	Class uint16
+}
+
+// DNSRecord 资源记录，Data 为按类型解析后的数据
+type DNSRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16 // OPT 记录中表示 UDP 载荷大小
+	TTL   uint32 // OPT 记录中表示扩展 RCODE、版本与标志位
+	Data  DNSRecordData
+}
+
+// DNSRecordData 资源记录数据
+type DNSRecordData interface {
+	pack(b []byte, comp map[string]int) ([]byte, error)
+}
+
+// DNSAddress A/AAAA 记录
+type DNSAddress struct {
+	IP net.IP
+}
+
+// DNSName CNAME/NS/PTR 记录
+type DNSName struct {
+	Name string
+}
+
+// DNSSOA SOA 记录（否定应答的缓存时间取自其中，RFC 2308）
+type DNSSOA struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+// DNSTXT TXT 记录
+type DNSTXT struct {
+	Texts []string
+}
+
+// DNSSVCB HTTPS/SVCB 记录（RFC 9460）
+type DNSSVCB struct {
+	Priority uint16
+	Target   string
+	Params   []SvcParam
+}
+
+// SvcParam SVCB 参数
+type SvcParam struct {
+	Key   uint16
+	Value []byte
+}
+
+// DNSOPT EDNS0 OPT 伪记录（RFC 6891）
+type DNSOPT struct {
+	Options []EDNSOption
+}
+
+// EDNSOption EDNS0 选项
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// DNSRaw 未识别类型的原始数据
+type DNSRaw struct {
+	Data []byte
+}
+
+// NewDNSQuery 构造带 EDNS0 的单问题递归查询（ID 为 0，便于 DoH 缓存）
+func NewDNSQuery(name string, qtype uint16) *DNSMessage {
+	return &DNSMessage{
+		RecursionDesired: true,
+		Questions:        []DNSQuestion{{Name: name, Type: qtype, Class: ClassINET}},
+		Additionals: []DNSRecord{{
+			Type:  TypeOPT,
+			Class: ednsUDPSize,
+			Data:  &DNSOPT{},
+		}},
+	}
+}
+
+// Reply 基于查询构造应答骨架（复制 ID、问题与 RD 标志）
+func (m *DNSMessage) Reply() *DNSMessage {
+	return &DNSMessage{
+		ID:                 m.ID,
+		Response:           true,
+		Opcode:             m.Opcode,
+		RecursionDesired:   m.RecursionDesired,
+		RecursionAvailable: true,
+		CheckingDisabled:   m.CheckingDisabled,
+		Questions:          append([]DNSQuestion(nil), m.Questions...),
+	}
+}
+
+// Question 返回第一个问题
+func (m *DNSMessage) Question() (DNSQuestion, bool) {
+	if len(m.Questions) == 0 {
+		return DNSQuestion{}, false
+	}
+	return m.Questions[0], true
+}
+
+// IPs 返回应答段中的所有 A/AAAA 地址
+func (m *DNSMessage) IPs() []net.IP {
+	var ips []net.IP
+	for _, rr := range m.Answers {
+		if addr, ok := rr.Data.(*DNSAddress); ok {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return ips
+}
+
+// ECHConfigList 返回应答段中第一个带 ech 参数的 HTTPS/SVCB 记录的 ECHConfigList
+func (m *DNSMessage) ECHConfigList() []byte {
+	for _, rr := range m.Answers {
+		svcb, ok := rr.Data.(*DNSSVCB)
+		if !ok {
+			continue
+		}
+		if value, ok := svcb.Param(SvcParamECH); ok && len(value) != 0 {
+			return value
+		}
+	}
+	return nil
+}
+
+// MinTTL 返回应答段中最小的 TTL（无应答时返回 0, false）
+func (m *DNSMessage) MinTTL() (uint32, bool) {
+	found := false
+	var minTTL uint32
+	for _, rr := range m.Answers {
+		if !found || rr.TTL < minTTL {
+			minTTL = rr.TTL
+			found = true
+		}
+	}
+	return minTTL, found
+}
+
+// NegativeTTL 返回否定应答的缓存时间：授权段 SOA 的 TTL 与 MINIMUM 中较小者（RFC 2308 第 5 节）
+func (m *DNSMessage) NegativeTTL() (uint32, bool) {
+	for _, rr := range m.Authorities {
+		if soa, ok := rr.Data.(*DNSSOA); ok {
+			return min(rr.TTL, soa.Minimum), true
+		}
+	}
+	return 0, false
+}
+
+// Param 返回指定 SvcParamKey 的值
+func (s *DNSSVCB) Param(key uint16) ([]byte, bool) {
+	for _, p := range s.Params {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ======================== 解码 ========================
+
+// ParseDNSMessage 解析 DNS 报文
+func ParseDNSMessage(b []byte) (*DNSMessage, error) {
+	if len(b) < dnsHeaderLen {
+		return nil, errDNSTruncated
+	}
+	flags := binary.BigEndian.Uint16(b[2:4])
+	m := &DNSMessage{
+		ID:                 binary.BigEndian.Uint16(b[0:2]),
+		Response:           flags&0x8000 != 0,
+		Opcode:             uint8(flags>>11) & 0x0F,
+		Authoritative:      flags&0x0400 != 0,
+		Truncated:          flags&0x0200 != 0,
+		RecursionDesired:   flags&0x0100 != 0,
+		RecursionAvailable: flags&0x0080 != 0,
+		AuthenticData:      flags&0x0020 != 0,
+		CheckingDisabled:   flags&0x0010 != 0,
+		RCode:              uint8(flags & 0x000F),
+	}
+	qdcount := int(binary.BigEndian.Uint16(b[4:6]))
+	ancount := int(binary.BigEndian.Uint16(b[6:8]))
+	nscount := int(binary.BigEndian.Uint16(b[8:10]))
+	arcount := int(binary.BigEndian.Uint16(b[10:12]))
+
+	offset := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readDNSName(b, offset)
+		if err != nil {
+			return nil, fmt.Errorf("问题段: %w", err)
+		}
+		if next+4 > len(b) {
+			return nil, errDNSTruncated
+		}
+		m.Questions = append(m.Questions, DNSQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next : next+2]),
+			Class: binary.BigEndian.Uint16(b[next+2 : next+4]),
+		})
+		offset = next + 4
+	}
+
+	var err error
+	if m.Answers, offset, err = readDNSRecords(b, offset, ancount); err != nil {
+		return nil, fmt.Errorf("应答段: %w", err)
+	}
+	if m.Authorities, offset, err = readDNSRecords(b, offset, nscount); err != nil {
+		return nil, fmt.Errorf("授权段: %w", err)
+	}
+	if m.Additionals, _, err = readDNSRecords(b, offset, arcount); err != nil {
+		return nil, fmt.Errorf("附加段: %w", err)
+	}
+	return m, nil
+}
+
+func readDNSRecords(b []byte, offset, count int) ([]DNSRecord, int, error) {
+	var records []DNSRecord
+	for i := 0; i < count; i++ {
+		name, next, err := readDNSName(b, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		if next+10 > len(b) {
+			return nil, 0, errDNSTruncated
+		}
+		rr := DNSRecord{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next : next+2]),
+			Class: binary.BigEndian.Uint16(b[next+2 : next+4]),
+			TTL:   binary.BigEndian.Uint32(b[next+4 : next+8]),
+		}
+		dataLen := int(binary.BigEndian.Uint16(b[next+8 : next+10]))
+		start := next + 10
+		end := start + dataLen
+		if end > len(b) {
+			return nil, 0, errDNSTruncated
+		}
+		if rr.Data, err = readDNSRecordData(b, start, end, rr.Type); err != nil {
+			return nil, 0, fmt.Errorf("%s 类型 %d: %w", name, rr.Type, err)
+		}
+		records = append(records, rr)
+		offset = end
+	}
+	return records, offset, nil
+}
+
+// readDNSRecordData 解析 [start, end) 范围内的记录数据，域名压缩指针相对整个报文
+func readDNSRecordData(b []byte, start, end int, rrType uint16) (DNSRecordData, error) {
+	data := b[start:end]
+	switch rrType {
+	case TypeA, TypeAAAA:
+		if (rrType == TypeA && len(data) != net.IPv4len) || (rrType == TypeAAAA && len(data) != net.IPv6len) {
+			return nil, errors.New("地址长度错误")
+		}
+		return &DNSAddress{IP: append(net.IP(nil), data...)}, nil
+
+	case TypeCNAME, TypeNS, TypePTR:
+		name, next, err := readDNSName(b[:end], start)
+		if err != nil {
+			return nil, err
+		}
+		if next != end {
+			return nil, errors.New("记录数据长度错误")
+		}
+		return &DNSName{Name: name}, nil
+
+	case TypeSOA:
+		mname, next, err := readDNSName(b[:end], start)
+		if err != nil {
+			return nil, err
+		}
+		rname, next, err := readDNSName(b[:end], next)
+		if err != nil {
+			return nil, err
+		}
+		if next+20 != end {
+			return nil, errors.New("记录数据长度错误")
+		}
+		return &DNSSOA{
+			MName:   mname,
+			RName:   rname,
+			Serial:  binary.BigEndian.Uint32(b[next : next+4]),
+			Refresh: binary.BigEndian.Uint32(b[next+4 : next+8]),
+			Retry:   binary.BigEndian.Uint32(b[next+8 : next+12]),
+			Expire:  binary.BigEndian.Uint32(b[next+12 : next+16]),
+			Minimum: binary.BigEndian.Uint32(b[next+16 : next+20]),
+		}, nil
+
+	case TypeTXT:
+		txt := &DNSTXT{}
+		for off := 0; off < len(data); {
+			l := int(data[off])
+			if off+1+l > len(data) {
+				return nil, errDNSTruncated
+			}
+			txt.Texts = append(txt.Texts, string(data[off+1:off+1+l]))
+			off += 1 + l
+		}
+		return txt, nil
+
+	case TypeSVCB, TypeHTTPS:
+		if len(data) < 3 {
+			return nil, errDNSTruncated
+		}
+		svcb := &DNSSVCB{Priority: binary.BigEndian.Uint16(data[0:2])}
+		// TargetName 不允许压缩（RFC 9460 2.2），此处仍按通用规则读取以兼容不规范的实现
+		target, next, err := readDNSName(b[:end], start+2)
+		if err != nil {
+			return nil, err
+		}
+		svcb.Target = target
+		lastKey := -1
+		for off := next; off < end; {
+			if off+4 > end {
+				return nil, errDNSTruncated
+			}
+			key := binary.BigEndian.Uint16(b[off : off+2])
+			l := int(binary.BigEndian.Uint16(b[off+2 : off+4]))
+			if off+4+l > end {
+				return nil, errDNSTruncated
+			}
+			if int(key) <= lastKey {
+				return nil, errors.New("SvcParamKey 未按升序排列")
+			}
+			lastKey = int(key)
+			svcb.Params = append(svcb.Params, SvcParam{Key: key, Value: append([]byte(nil), b[off+4:off+4+l]...)})
+			off += 4 + l
+		}
+		return svcb, nil
+
+	case TypeOPT:
+		opt := &DNSOPT{}
+		for off := 0; off < len(data); {
+			if off+4 > len(data) {
+				return nil, errDNSTruncated
+			}
+			code := binary.BigEndian.Uint16(data[off : off+2])
+			l := int(binary.BigEndian.Uint16(data[off+2 : off+4]))
+			if off+4+l > len(data) {
+				return nil, errDNSTruncated
+			}
+			opt.Options = append(opt.Options, EDNSOption{Code: code, Data: append([]byte(nil), data[off+4:off+4+l]...)})
+			off += 4 + l
+		}
+		return opt, nil
+
+	default:
+		return &DNSRaw{Data: append([]byte(nil), data...)}, nil
+	}
+}
+
+// readDNSName 读取 offset 处的域名（支持压缩指针），返回域名与其后的偏移
+func readDNSName(b []byte, offset int) (string, int, error) {
+	var name strings.Builder
+	next := -1
+	nameLen := 1
+	// 压缩指针只能指向更早的位置，以此防止循环
+	limit := offset
+	for {
+		if offset >= len(b) {
+			return "", 0, errDNSTruncated
+		}
+		l := int(b[offset])
+		switch l & 0xC0 {
+		case 0x00:
+			if l == 0 {
+				if next < 0 {
+					next = offset + 1
+				}
+				return name.String(), next, nil
+			}
+			if offset+1+l > len(b) {
+				return "", 0, errDNSTruncated
+			}
+			if nameLen += l + 1; nameLen > maxDNSNameLen {
+				return "", 0, errDNSBadName
+			}
+			if name.Len() != 0 {
+				name.WriteByte('.')
+			}
+			escapeDNSLabel(&name, b[offset+1:offset+1+l])
+			offset += 1 + l
+		case 0xC0:
+			if offset+2 > len(b) {
+				return "", 0, errDNSTruncated
+			}
+			ptr := int(binary.BigEndian.Uint16(b[offset:offset+2]) & maxPointer)
+			if ptr >= limit {
+				return "", 0, errDNSBadName
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset, limit = ptr, ptr
+		default:
+			// 0x40 / 0x80 为保留的标签类型
+			return "", 0, errDNSBadName
+		}
+	}
+}
+
+// ======================== 编码 ========================
+
+// Pack 编码 DNS 报文（对记录所有者名与 CNAME/NS/PTR 目标使用名称压缩）
+func (m *DNSMessage) Pack() ([]byte, error) {
+	if len(m.Questions) > 0xFFFF || len(m.Answers) > 0xFFFF || len(m.Authorities) > 0xFFFF || len(m.Additionals) > 0xFFFF {
+		return nil, errors.New("记录数量过多")
+	}
+	var flags uint16
+	if m.Response {
+		flags |= 0x8000
+	}
+	flags |= uint16(m.Opcode&0x0F) << 11
+	if m.Authoritative {
+		flags |= 0x0400
+	}
+	if m.Truncated {
+		flags |= 0x0200
+	}
+	if m.RecursionDesired {
+		flags |= 0x0100
+	}
+	if m.RecursionAvailable {
+		flags |= 0x0080
+	}
+	if m.AuthenticData {
+		flags |= 0x0020
+	}
+	if m.CheckingDisabled {
+		flags |= 0x0010
+	}
+	flags |= uint16(m.RCode & 0x0F)
+
+	b := make([]byte, dnsHeaderLen, 512)
+	binary.BigEndian.PutUint16(b[0:2], m.ID)
+	binary.BigEndian.PutUint16(b[2:4], flags)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:10], uint16(len(m.Authorities)))
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(m.Additionals)))
+
+	comp := make(map[string]int)
+	var err error
+	for _, q := range m.Questions {
+		if b, err = packDNSName(b, q.Name, comp); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+	for _, section := range [][]DNSRecord{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			if b, err = section[i].pack(b, comp); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+func (rr *DNSRecord) pack(b []byte, comp map[string]int) ([]byte, error) {
+	var err error
+	if b, err = packDNSName(b, rr.Name, comp); err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, rr.Type)
+	b = binary.BigEndian.AppendUint16(b, rr.Class)
+	b = binary.BigEndian.AppendUint32(b, rr.TTL)
+	lenOffset := len(b)
+	b = append(b, 0, 0)
+	if addr, ok := rr.Data.(*DNSAddress); ok && rr.Type == TypeAAAA {
+		// IPv4 映射地址（::ffff:a.b.c.d）在 AAAA 记录中仍为 16 字节
+		ip6 := addr.IP.To16()
+		if ip6 == nil {
+			return nil, errors.New("无效的 IP 地址")
+		}
+		b = append(b, ip6...)
+	} else if rr.Data != nil {
+		if b, err = rr.Data.pack(b, comp); err != nil {
+			return nil, err
+		}
+	}
+	dataLen := len(b) - lenOffset - 2
+	if dataLen > 0xFFFF {
+		return nil, errors.New("记录数据过长")
+	}
+	binary.BigEndian.PutUint16(b[lenOffset:], uint16(dataLen))
+	return b, nil
+}
+
+func (d *DNSAddress) pack(b []byte, _ map[string]int) ([]byte, error) {
+	if ip4 := d.IP.To4(); ip4 != nil {
+		return append(b, ip4...), nil
+	}
+	if ip6 := d.IP.To16(); ip6 != nil {
+		return append(b, ip6...), nil
+	}
+	return nil, errors.New("无效的 IP 地址")
+}
+
+func (d *DNSName) pack(b []byte, comp map[string]int) ([]byte, error) {
+	return packDNSName(b, d.Name, comp)
+}
+
+func (d *DNSSOA) pack(b []byte, comp map[string]int) ([]byte, error) {
+	var err error
+	if b, err = packDNSName(b, d.MName, comp); err != nil {
+		return nil, err
+	}
+	if b, err = packDNSName(b, d.RName, comp); err != nil {
+		return nil, err
+	}
+	for _, v := range []uint32{d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b, nil
+}
+
+func (d *DNSTXT) pack(b []byte, _ map[string]int) ([]byte, error) {
+	for _, text := range d.Texts {
+		// 超过 255 字节的文本拆分为多个字符串
+		for {
+			chunk := text
+			if len(chunk) > 255 {
+				chunk = chunk[:255]
+			}
+			b = append(b, byte(len(chunk)))
+			b = append(b, chunk...)
+			text = text[len(chunk):]
+			if len(text) == 0 {
+				break
+			}
+		}
+	}
+	return b, nil
+}
+
+func (d *DNSSVCB) pack(b []byte, _ map[string]int) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, d.Priority)
+	var err error
+	if b, err = packDNSName(b, d.Target, nil); err != nil {
+		return nil, err
+	}
+	for _, p := range d.Params {
+		if len(p.Value) > 0xFFFF {
+			return nil, errors.New("SvcParam 过长")
+		}
+		b = binary.BigEndian.AppendUint16(b, p.Key)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(p.Value)))
+		b = append(b, p.Value...)
+	}
+	return b, nil
+}
+
+func (d *DNSOPT) pack(b []byte, _ map[string]int) ([]byte, error) {
+	for _, o := range d.Options {
+		if len(o.Data) > 0xFFFF {
+			return nil, errors.New("EDNS 选项过长")
+		}
+		b = binary.BigEndian.AppendUint16(b, o.Code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.Data)))
+		b = append(b, o.Data...)
+	}
+	return b, nil
+}
+
+func (d *DNSRaw) pack(b []byte, _ map[string]int) ([]byte, error) {
+	return append(b, d.Data...), nil
+}
+
+// packDNSName 编码域名（文本格式，标签中的 '.'、'\\' 与不可打印字符为转义形式），comp 为 nil 时不压缩
+func packDNSName(b []byte, name string, comp map[string]int) ([]byte, error) {
+	labels, starts, err := splitDNSName(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, label := range labels {
+		// 区分大小写，保留名称原样（0x20 编码的查询需要应答原样回显）
+		suffix := name[starts[i]:]
+		if comp != nil {
+			if ptr, ok := comp[suffix]; ok {
+				return binary.BigEndian.AppendUint16(b, uint16(0xC000|ptr)), nil
+			}
+			if len(b) <= maxPointer {
+				comp[suffix] = len(b)
+			}
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+// escapeDNSLabel 按文本格式写入标签（RFC 1035 5.1），保证解析后重新编码得到相同的标签
+func escapeDNSLabel(name *strings.Builder, label []byte) {
+	for _, c := range label {
+		switch {
+		case c == '.' || c == '\\':
+			name.WriteByte('\\')
+			name.WriteByte(c)
+		case c < '!' || c > '~':
+			fmt.Fprintf(name, "\\%03d", c)
+		default:
+			name.WriteByte(c)
+		}
+	}
+}
+
+// splitDNSName 将文本格式的域名拆分为标签并还原转义，starts 为各标签在 name 中的起始位置；
+// 末尾的点（未转义）可省略，空字符串与 "." 为根域
+func splitDNSName(name string) (labels [][]byte, starts []int, err error) {
+	if name == "." {
+		return nil, nil, nil
+	}
+	wireLen := 1
+	var label []byte
+	start := 0
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch c {
+		case '.':
+			if len(label) == 0 || len(label) > maxDNSLabel {
+				return nil, nil, errDNSBadName
+			}
+			labels, starts = append(labels, label), append(starts, start)
+			wireLen += len(label) + 1
+			label, start = nil, i+1
+			continue
+		case '\\':
+			if i+1 >= len(name) {
+				return nil, nil, errDNSBadName
+			}
+			i++
+			c = name[i]
+			if c >= '0' && c <= '9' {
+				if i+2 >= len(name) {
+					return nil, nil, errDNSBadName
+				}
+				v := 0
+				for _, d := range []byte(name[i : i+3]) {
+					if d < '0' || d > '9' {
+						return nil, nil, errDNSBadName
+					}
+					v = v*10 + int(d-'0')
+				}
+				if v > 0xFF {
+					return nil, nil, errDNSBadName
+				}
+				c = byte(v)
+				i += 2
+			}
+		}
+		label = append(label, c)
+	}
+	if len(label) != 0 {
+		if len(label) > maxDNSLabel {
+			return nil, nil, errDNSBadName
+		}
+		labels, starts = append(labels, label), append(starts, start)
+		wireLen += len(label) + 1
+	}
+	if wireLen > maxDNSNameLen {
+		return nil, nil, errDNSBadName
+	}
+	return labels, starts, nil
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// 种子报文：查询、CNAME 链、HTTPS（含 ech）、NXDOMAIN + SOA、SVCB 别名模式 + TXT，
+// 除查询外均使用压缩指针（SOA 的 MNAME/RNAME 指向问题段中的后缀）
+var dnsSeedMessages = map[string]string{
+	"queryA":    "3b1f0120000100000000000103777777076578616d706c6503636f6d000001000100002904d000000000000c000a0008d5a4e3f2b1c09788",
+	"cnameA":    "8a4181800001000200000001037777770667697468756203636f6d0000010001c00c0005000100000e100002c010c010000100010000003c00048c52700300002904d0000000000000",
+	"https":     "5d02818000010001000000000663727970746f0a636c6f7564666c61726503636f6d0000410001c00c004100010000012c0079000100000100060268330268320004000868120a7668120b76000500480045fe0d0041a10020002088e0c4f7e5c3b1a2d4e6f8091a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e0004000100010012636c6f7564666c6172652d6563682e636f6d00000006001026064700000000000000000068120a76",
+	"nxSOA":     "123481830001000000010000046e6f7065076578616d706c65036f726700001c0001c01100060001000003840027036e7331c0110a686f73746d6173746572c01178a3f17500001c2000000e10001275000000012c",
+	"svcbAlias": "004285800001000200000000045f646e73087265736f6c76657204617270610000400001c00c0040000100000e10000e000003646e7306676f6f676c6500c00c001000010000003c00070568656c6c6f00",
+}
+
+func dnsSeed(t testing.TB, name string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(dnsSeedMessages[name])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// checkDNSRoundTrip 解析 -> 编码 -> 解析应得到相同的报文
+func checkDNSRoundTrip(t *testing.T, b []byte) {
+	t.Helper()
+	m, err := ParseDNSMessage(b)
+	if err != nil {
+		return
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatalf("编码失败: %v\n%#v", err, m)
+	}
+	m2, err := ParseDNSMessage(packed)
+	if err != nil {
+		t.Fatalf("重新解析失败: %v\n%x", err, packed)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Fatalf("往返结果不一致:\n%#v\n%#v", m, m2)
+	}
+}
+
+func TestDNSMessageRoundTrip(t *testing.T) {
+	for name := range dnsSeedMessages {
+		t.Run(name, func(t *testing.T) {
+			b := dnsSeed(t, name)
+			if _, err := ParseDNSMessage(b); err != nil {
+				t.Fatal(err)
+			}
+			checkDNSRoundTrip(t, b)
+		})
+	}
+}
+
+func TestDNSMessageSeeds(t *testing.T) {
+	m, err := ParseDNSMessage(dnsSeed(t, "cnameA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Answers[0].Data.(*DNSName).Name; got != "github.com" {
+		t.Errorf("CNAME = %q", got)
+	}
+	if ips := m.IPs(); len(ips) != 1 || ips[0].String() != "140.82.112.3" {
+		t.Errorf("IPs = %v", ips)
+	}
+
+	m, err = ParseDNSMessage(dnsSeed(t, "https"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ech := m.ECHConfigList(); len(ech) != 0x48 || ech[2] != 0xfe || ech[3] != 0x0d {
+		t.Errorf("ECHConfigList = %x", ech)
+	}
+
+	m, err = ParseDNSMessage(dnsSeed(t, "nxSOA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	soa := m.Authorities[0].Data.(*DNSSOA)
+	if soa.MName != "ns1.example.org" || soa.RName != "hostmaster.example.org" {
+		t.Errorf("SOA = %+v", soa)
+	}
+	if ttl, ok := m.NegativeTTL(); !ok || ttl != 300 {
+		t.Errorf("NegativeTTL = %d, %v", ttl, ok)
+	}
+}
+
+func TestDNSNameEscaping(t *testing.T) {
+	// 标签 "a.b"、"c\d" 与含空格和 0xff 的标签
+	wire := []byte("\x03a.b\x03c\\d\x03e f\x01\xff\x03com\x00")
+	b := append(make([]byte, dnsHeaderLen), wire...)
+	b = append(b, 0, 1, 0, 1)
+	b[5] = 1 // QDCOUNT
+
+	m, err := ParseDNSMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `a\.b.c\\d.e\032f.\255.com`
+	if got := m.Questions[0].Name; got != want {
+		t.Fatalf("Name = %q, want %q", got, want)
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packed, b) {
+		t.Fatalf("编码结果不同:\n%x\n%x", packed, b)
+	}
+
+	for _, name := range []string{`a\`, `a\25`, `a\256`, "a..b", ".a"} {
+		if _, err := packDNSName(nil, name, nil); err == nil {
+			t.Errorf("packDNSName(%q) 应失败", name)
+		}
+	}
+	for name, want := range map[string]string{"": "\x00", ".": "\x00", "a.": "\x01a\x00", `a\.`: "\x02a.\x00"} {
+		got, err := packDNSName(nil, name, nil)
+		if err != nil || string(got) != want {
+			t.Errorf("packDNSName(%q) = %q, %v", name, got, err)
+		}
+	}
+}
+
+func FuzzParseDNSMessage(f *testing.F) {
+	for name := range dnsSeedMessages {
+		f.Add(dnsSeed(f, name))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkDNSRoundTrip(t, b)
+	})
+}
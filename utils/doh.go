@@ -1,147 +1,31 @@
-//nolint:errcheck
 package utils
 
 import (
-	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"strings"
 )
 
-// QueryHTTPSRecord 通过 DoH 查询 HTTPS 记录
-func QueryHTTPSRecord(domain, dnsServer string) (string, error) {
-	dohURL := dnsServer
-	if !strings.HasPrefix(dohURL, "https://") && !strings.HasPrefix(dohURL, "http://") {
-		dohURL = "https://" + dohURL
-	}
-	return queryDoH(domain, dohURL)
-}
-
-// queryDoH 执行 DoH 查询（用于获取 ECH 配置）
-func queryDoH(domain, dohURL string) (string, error) {
-	u, err := url.Parse(dohURL)
+// QueryHTTPSRecord 通过 exchange 查询域名的 HTTPS 记录，返回其中的 ECHConfigList（没有时返回 nil）与应答 TTL
+func QueryHTTPSRecord(exchange func(query []byte) ([]byte, error), domain string) ([]byte, uint32, error) {
+	dnsQuery, err := NewDNSQuery(domain, TypeHTTPS).Pack()
 	if err != nil {
-		return "", fmt.Errorf("无效的 DoH URL: %v", err)
+		return nil, 0, fmt.Errorf("构造 DNS 查询失败: %v", err)
 	}
-
-	dnsQuery := buildDNSQuery(domain, typeHTTPS)
-	dnsBase64 := base64.RawURLEncoding.EncodeToString(dnsQuery)
-
-	q := u.Query()
-	q.Set("dns", dnsBase64)
-	u.RawQuery = q.Encode()
-
-	resp, err := GetDataByUrl(u.String(), map[string]string{
-		"Accept":       "application/dns-message",
-		"Content-Type": "application/dns-message",
-	})
-
+	resp, err := exchange(dnsQuery)
 	if err != nil {
-		return "", fmt.Errorf("DoH 请求失败: %v", err)
+		return nil, 0, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("DoH 服务器返回错误: %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
+	msg, err := ParseDNSMessage(resp)
 	if err != nil {
-		return "", fmt.Errorf("读取 DoH 响应失败: %v", err)
-	}
-
-	return parseDNSResponse(body)
-}
-
-func buildDNSQuery(domain string, qtype uint16) []byte {
-	query := make([]byte, 0, 512)
-	query = append(query, 0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
-	for _, label := range strings.Split(domain, ".") {
-		query = append(query, byte(len(label)))
-		query = append(query, []byte(label)...)
-	}
-	query = append(query, 0x00, byte(qtype>>8), byte(qtype), 0x00, 0x01)
-	return query
-}
-
-func parseDNSResponse(response []byte) (string, error) {
-	if len(response) < 12 {
-		return "", errors.New("响应过短")
-	}
-	ancount := binary.BigEndian.Uint16(response[6:8])
-	if ancount == 0 {
-		return "", errors.New("无应答记录")
-	}
-
-	offset := 12
-	for offset < len(response) && response[offset] != 0 {
-		offset += int(response[offset]) + 1
-	}
-	offset += 5
-
-	for i := 0; i < int(ancount); i++ {
-		if offset >= len(response) {
-			break
-		}
-		if response[offset]&0xC0 == 0xC0 {
-			offset += 2
-		} else {
-			for offset < len(response) && response[offset] != 0 {
-				offset += int(response[offset]) + 1
-			}
-			offset++
-		}
-		if offset+10 > len(response) {
-			break
-		}
-		rrType := binary.BigEndian.Uint16(response[offset : offset+2])
-		offset += 8
-		dataLen := binary.BigEndian.Uint16(response[offset : offset+2])
-		offset += 2
-		if offset+int(dataLen) > len(response) {
-			break
-		}
-		data := response[offset : offset+int(dataLen)]
-		offset += int(dataLen)
-
-		if rrType == typeHTTPS {
-			if ech := parseHTTPSRecord(data); len(ech) != 0 {
-				return ech, nil
-			}
-		}
-	}
-	return "", nil
-}
-
-func parseHTTPSRecord(data []byte) string {
-	if len(data) < 2 {
-		return ""
+		return nil, 0, fmt.Errorf("解析 DNS 响应失败: %v", err)
 	}
-	offset := 2
-	if offset < len(data) && data[offset] == 0 {
-		offset++
-	} else {
-		for offset < len(data) && data[offset] != 0 {
-			offset += int(data[offset]) + 1
-		}
-		offset++
+	if msg.RCode != RCodeSuccess {
+		return nil, 0, fmt.Errorf("DNS 响应错误码: %d", msg.RCode)
 	}
-	for offset+4 <= len(data) {
-		key := binary.BigEndian.Uint16(data[offset : offset+2])
-		length := binary.BigEndian.Uint16(data[offset+2 : offset+4])
-		offset += 4
-		if offset+int(length) > len(data) {
-			break
-		}
-		value := data[offset : offset+int(length)]
-		offset += int(length)
-		if key == 5 {
-			return base64.StdEncoding.EncodeToString(value)
-		}
+	if len(msg.Answers) == 0 {
+		return nil, 0, errors.New("无应答记录")
 	}
-	return ""
+	ttl, _ := msg.MinTTL()
+	return msg.ECHConfigList(), ttl, nil
 }
@@ -0,0 +1,168 @@
+//nolint:errcheck
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dohTimeout     = 10 * time.Second
+	dohMaxRespSize = 65535
+)
+
+// directDoHTransport 直连 DoH 共用的连接池（ECH 配置查询、国内域名解析）
+var directDoHTransport = NewDoHTransport()
+
+// NewDoHTransport 创建 DoH 使用的连接池，优先 HTTP/2 复用连接
+func NewDoHTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:               nil,
+		DialContext:         NewDialer(dohTimeout).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: dohTimeout,
+	}
+}
+
+// DoHClient DNS over HTTPS 客户端（RFC 8484），支持多个服务器之间竞速或依次回退
+type DoHClient struct {
+	Method string // http.MethodPost 或 http.MethodGet
+	Race   bool   // 同时向所有服务器查询，取最先成功的结果
+
+	servers   []string
+	client    *http.Client
+	preferred atomic.Int32 // 回退模式下最近一次成功的服务器
+}
+
+// NewDoHClient 创建 DoH 客户端，transport 为 nil 时使用共用的直连连接池
+func NewDoHClient(servers []string, transport *http.Transport) *DoHClient {
+	if transport == nil {
+		transport = directDoHTransport
+	}
+	urls := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if server = strings.TrimSpace(server); len(server) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(server, "https://") && !strings.HasPrefix(server, "http://") {
+			server = "https://" + server
+		}
+		urls = append(urls, server)
+	}
+	return &DoHClient{
+		Method:  http.MethodPost,
+		servers: urls,
+		client:  &http.Client{Transport: transport, Timeout: dohTimeout},
+	}
+}
+
+// Servers 返回服务器列表
+func (c *DoHClient) Servers() []string {
+	return c.servers
+}
+
+// Exchange 发送原始 DNS 报文并返回原始响应
+func (c *DoHClient) Exchange(query []byte) ([]byte, error) {
+	if len(c.servers) == 0 {
+		return nil, errors.New("未配置 DoH 服务器")
+	}
+	if len(query) < dnsHeaderLen {
+		return nil, errDNSTruncated
+	}
+	if c.Race && len(c.servers) > 1 {
+		return c.race(query)
+	}
+
+	start := int(c.preferred.Load())
+	var lastErr error
+	for i := range c.servers {
+		idx := (start + i) % len(c.servers)
+		resp, err := c.exchange(context.Background(), c.servers[idx], query)
+		if err == nil {
+			c.preferred.Store(int32(idx))
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (c *DoHClient) race(query []byte) ([]byte, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	results := make(chan result, len(c.servers))
+	for _, server := range c.servers {
+		go func() {
+			resp, err := c.exchange(ctx, server, query)
+			results <- result{resp, err}
+		}()
+	}
+	var lastErr error
+	for range c.servers {
+		r := <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+		lastErr = r.err
+	}
+	return nil, lastErr
+}
+
+func (c *DoHClient) exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	var req *http.Request
+	var err error
+	if c.Method == http.MethodGet {
+		// GET 请求使用 ID 0 以便 HTTP 缓存（RFC 8484 4.1），响应中再还原
+		wire := append([]byte(nil), query...)
+		wire[0], wire[1] = 0, 0
+		sep := "?"
+		if strings.Contains(server, "?") {
+			sep = "&"
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			server+sep+"dns="+base64.RawURLEncoding.EncodeToString(wire), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/dns-message")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无效的 DoH URL: %v", err)
+	}
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH 请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH 服务器返回错误: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dohMaxRespSize))
+	if err != nil {
+		return nil, fmt.Errorf("读取 DoH 响应失败: %v", err)
+	}
+	if len(body) < dnsHeaderLen {
+		return nil, errDNSTruncated
+	}
+	body[0], body[1] = query[0], query[1]
+	return body, nil
+}
@@ -0,0 +1,26 @@
+package utils
+
+import "sync"
+
+var (
+	exitHooksMu sync.Mutex
+	exitHooks   []func()
+)
+
+// OnExit 注册退出时需要执行的善后函数（按注册的逆序执行）
+func OnExit(fn func()) {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	exitHooks = append(exitHooks, fn)
+}
+
+// RunExitHooks 执行所有已注册的善后函数
+func RunExitHooks() {
+	exitHooksMu.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitHooksMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
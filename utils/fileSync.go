@@ -28,13 +28,20 @@ func NewFileSync(tag string, fileName string, source func() ([]byte, error)) *Fi
 	}
 }
 
-func (f *FileSync) Sync() (data []byte, err error) {
+// ExeFilePath 返回可执行文件所在目录下的文件路径
+func ExeFilePath(fileName string) (string, error) {
 	exePath, err := os.Executable()
 	if err != nil {
-		return nil, fmt.Errorf("获取可执行文件路径失败: %w", err)
+		return "", fmt.Errorf("获取可执行文件路径失败: %w", err)
+	}
+	return filepath.Join(filepath.Dir(exePath), fileName), nil
+}
+
+func (f *FileSync) Sync() (data []byte, err error) {
+	fileFullName, err := ExeFilePath(f.fileName)
+	if err != nil {
+		return nil, err
 	}
-	exeDir := filepath.Dir(exePath)
-	fileFullName := filepath.Join(exeDir, f.fileName)
 
 	needDownload := false
 	if info, err := os.Stat(fileFullName); os.IsNotExist(err) {
@@ -0,0 +1,85 @@
+//go:build linux
+
+// nolint: errcheck
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/newde36524/ew/utils/log"
+)
+
+// 策略路由优先级：自身流量走主路由表 -> 保留主表中的非默认路由 -> 其余流量进入 TUN
+const tunRulePriority = 9000
+
+// SetupTunDevice 为 TUN 设备配置地址、MTU 并启用
+func SetupTunDevice(name, cidr string, mtu int) error {
+	if err := runIP("addr", "replace", cidr, "dev", name); err != nil {
+		return err
+	}
+	return runIP("link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up")
+}
+
+// SetupTunRoutes 配置将默认流量导入 TUN 的策略路由，返回用于退出时清理的函数
+//
+// 本程序自身发起的连接（WebSocket、DoH、直连）带有 fwmark，会命中主路由表，
+// 因此上游 ServerIP 和直连流量不会再次进入 TUN 形成回环。
+func SetupTunRoutes(name string, table, mark int) (cleanup func(), err error) {
+	tableStr := strconv.Itoa(table)
+	markStr := strconv.Itoa(mark)
+	rules := [][]string{
+		{"rule", "add", "fwmark", markStr, "lookup", "main", "priority", strconv.Itoa(tunRulePriority)},
+		{"rule", "add", "lookup", "main", "suppress_prefixlength", "0", "priority", strconv.Itoa(tunRulePriority + 1)},
+		{"rule", "add", "lookup", tableStr, "priority", strconv.Itoa(tunRulePriority + 2)},
+	}
+
+	var undo [][]string
+	cleanup = func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			runIP(undo[i]...)
+		}
+		log.Printf("[TUN] 已清理路由规则")
+	}
+
+	for _, family := range []string{"-4", "-6"} {
+		route := []string{family, "route", "replace", "default", "dev", name, "table", tableStr}
+		if err := runIP(route...); err != nil {
+			if family == "-6" {
+				log.Printf("[TUN] 跳过 IPv6 路由: %v", err)
+				continue
+			}
+			cleanup()
+			return nil, err
+		}
+		undo = append(undo, []string{family, "route", "del", "default", "dev", name, "table", tableStr})
+
+		for _, rule := range rules {
+			args := append([]string{family}, rule...)
+			// 先删除可能残留的同名规则，避免重复添加
+			runIP(append([]string{family}, replaceAction(rule, "del")...)...)
+			if err := runIP(args...); err != nil {
+				cleanup()
+				return nil, err
+			}
+			undo = append(undo, append([]string{family}, replaceAction(rule, "del")...))
+		}
+	}
+	return cleanup, nil
+}
+
+func replaceAction(args []string, action string) []string {
+	out := append([]string(nil), args...)
+	out[1] = action
+	return out
+}
+
+func runIP(args ...string) error {
+	output, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s 失败: %v (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// 隧道协议版本，在 WebSocket 握手时协商：客户端在请求头 TunnelVersionHeader 中声明支持的最高版本，
+// 服务端在响应头中返回选用的版本，旧版服务端不返回时使用 v1
+const (
+	TunnelVersionHeader = "X-Tunnel-Version"
+
+	TunnelV1 = 1 // 文本控制帧 CONNECT:host:port|payload、CONNECTED、ERROR:msg、CLOSE，数据为二进制消息
+	TunnelV2 = 2 // 二进制控制帧，见 frameData 等
+)
+
+// v2 帧格式：每个 WebSocket 二进制消息以 1 字节帧类型开头
+//
+//	DATA      type | data
+//	CONNECT   type | atyp(1) | addr | port(2) | payload_len(4) | payload | TLV...
+//	CONNECTED type | TLV...
+//	ERROR     type | msg_len(2) | msg | TLV...
+//	CLOSE     type（中止连接，两个方向都结束）
+//	FIN       type（发送方不再发送数据，对方关闭远端连接的写端，另一方向继续转发）
+//
+// atyp 与 SOCKS5 相同（IPv4 4 字节、域名 1 字节长度 + 域名、IPv6 16 字节），
+// TLV 为 type(1) | len(2) | value，未知类型忽略
+const (
+	frameData      = 0x00
+	frameConnect   = 0x01
+	frameConnected = 0x02
+	frameError     = 0x03
+	frameClose     = 0x04
+	frameFin       = 0x05
+)
+
+const (
+	addrIPv4   = 0x01
+	addrDomain = 0x03
+	addrIPv6   = 0x04
+)
+
+// 元数据 TLV 类型
+const (
+	metaRequestID = 0x01 // 4 字节请求 ID，服务端在 CONNECTED / ERROR 中原样返回
+	metaProtocol  = 0x02 // 1 字节请求的协议，见 protocolTCP
+)
+
+const (
+	protocolTCP = 0x01
+	protocolUDP = 0x02
+)
+
+var errBadFrame = errors.New("隧道帧格式错误")
+
+// ErrTunnelClosed 服务端中止了隧道（v1 的 CLOSE 也视为中止，v1 不支持半关闭）
+var ErrTunnelClosed = errors.New("隧道已关闭")
+
+// NegotiatedTunnelVersion 根据 WebSocket 握手响应确定隧道协议版本
+func NegotiatedTunnelVersion(resp *http.Response) int {
+	if resp == nil {
+		return TunnelV1
+	}
+	if version, err := strconv.Atoi(resp.Header.Get(TunnelVersionHeader)); err == nil && version == TunnelV2 {
+		return TunnelV2
+	}
+	return TunnelV1
+}
+
+// appendTunnelAddr 按 atyp | addr | port 编码目标地址
+func appendTunnelAddr(b []byte, target string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("无效的端口: %s", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, addrIPv4), ip4...)
+		} else {
+			b = append(append(b, addrIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("无效的域名: %s", host)
+		}
+		b = append(append(b, addrDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+func appendTLV(b []byte, typ byte, value []byte) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// encodeConnectFrame 编码 v2 CONNECT 帧
+func encodeConnectFrame(target string, payload []byte, requestID uint32) ([]byte, error) {
+	frame := make([]byte, 0, 32+len(target)+len(payload))
+	frame = append(frame, frameConnect)
+	frame, err := appendTunnelAddr(frame, target)
+	if err != nil {
+		return nil, err
+	}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	frame = appendTLV(frame, metaRequestID, binary.BigEndian.AppendUint32(nil, requestID))
+	frame = appendTLV(frame, metaProtocol, []byte{protocolTCP})
+	return frame, nil
+}
+
+// parseTLVs 解析 TLV 列表，同一类型出现多次时取最后一个
+func parseTLVs(b []byte) (map[byte][]byte, error) {
+	meta := map[byte][]byte{}
+	for len(b) != 0 {
+		if len(b) < 3 || len(b) < 3+int(binary.BigEndian.Uint16(b[1:])) {
+			return nil, errBadFrame
+		}
+		n := 3 + int(binary.BigEndian.Uint16(b[1:]))
+		meta[b[0]] = b[3:n]
+		b = b[n:]
+	}
+	return meta, nil
+}
+
+// parseControlFrame 解析服务端发送的 v2 控制帧（CONNECTED 或 ERROR），返回 ERROR 的消息与元数据
+func parseControlFrame(frame []byte) (msg string, meta map[byte][]byte, err error) {
+	if len(frame) == 0 {
+		return "", nil, errBadFrame
+	}
+	tlvs := frame[1:]
+	switch frame[0] {
+	case frameConnected:
+	case frameError:
+		if len(frame) < 3 || len(frame) < 3+int(binary.BigEndian.Uint16(frame[1:])) {
+			return "", nil, errBadFrame
+		}
+		n := 3 + int(binary.BigEndian.Uint16(frame[1:]))
+		msg = string(frame[3:n])
+		tlvs = frame[n:]
+	default:
+		return "", nil, fmt.Errorf("意外的隧道帧: 0x%02x", frame[0])
+	}
+	meta, err = parseTLVs(tlvs)
+	return msg, meta, err
+}
+
+// parseConnectResponse 解析 v2 CONNECT 的响应帧，并核对请求 ID
+func parseConnectResponse(frame []byte, requestID uint32) error {
+	msg, meta, err := parseControlFrame(frame)
+	if err != nil {
+		return err
+	}
+	if id, ok := meta[metaRequestID]; ok && (len(id) != 4 || binary.BigEndian.Uint32(id) != requestID) {
+		return errors.New("隧道响应的请求 ID 不匹配")
+	}
+	if frame[0] == frameError {
+		return fmt.Errorf("%w: %s", ErrConnectRejected, msg)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -17,8 +18,9 @@ import (
 
 func init() {
 	http.DefaultClient.Timeout = 30 * time.Second
-	if transport, ok := http.DefaultClient.Transport.(*http.Transport); ok {
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
 		transport.Proxy = nil
+		transport.DialContext = NewDialer(30 * time.Second).DialContext
 	}
 }
 
@@ -84,6 +86,17 @@ func SendErrorResponse(conn io.ReadWriter, mode int) {
 	}
 }
 
+// SendRejectResponse 因连接数或速率限制拒绝请求
+func SendRejectResponse(conn io.ReadWriter, mode int) {
+	switch mode {
+	case ModeSOCKS5:
+		// 0x02: 规则不允许的连接
+		conn.Write([]byte{0x05, 0x02, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	case ModeHTTPConnect, ModeHTTPProxy:
+		conn.Write([]byte("HTTP/1.1 429 Too Many Requests\r\nRetry-After: 1\r\nContent-Length: 0\r\n\r\n"))
+	}
+}
+
 func SendSuccessResponse(conn io.ReadWriter, mode int) error {
 	switch mode {
 	case ModeSOCKS5:
@@ -102,10 +115,12 @@ func SendSuccessResponse(conn io.ReadWriter, mode int) error {
 }
 
 // HandleDirectConnection 处理直连（绕过代理）
-func HandleDirectConnection(conn io.ReadWriter, target, clientAddr string, mode int, firstFrame string) error {
+//
+// 按 throttle 限制上下行带宽；report 非 nil 时接收转发的字节数：连接建立后以首包长度（可能为 0）调用一次，
+// 之后两个方向的转发协程并发报告增量
+func HandleDirectConnection(conn net.Conn, target, clientAddr string, mode int, firstFrame string, throttle Throttle, report func(up, down int64)) error {
 	// 解析目标地址
-	_, _, err := net.SplitHostPort(target)
-	if err != nil {
+	if _, _, err := net.SplitHostPort(target); err != nil {
 		// 如果没有端口，根据模式添加默认端口
 		var port string
 		if mode == ModeHTTPConnect || mode == ModeHTTPProxy {
@@ -117,7 +132,7 @@ func HandleDirectConnection(conn io.ReadWriter, target, clientAddr string, mode
 	}
 
 	// 直接连接到目标
-	targetConn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	targetConn, err := NewDialer(10*time.Second).Dial("tcp", target)
 	if err != nil {
 		SendErrorResponse(conn, mode)
 		return fmt.Errorf("直连失败: %w", err)
@@ -135,27 +150,98 @@ func HandleDirectConnection(conn io.ReadWriter, target, clientAddr string, mode
 			return err
 		}
 	}
+	if report == nil {
+		report = func(up, down int64) {}
+	}
+	report(int64(len(firstFrame)), 0)
 
-	// 双向转发
-	done := make(chan bool, 2)
+	// 双向转发：一个方向读到 EOF 时只关闭另一端的写端（半关闭）；
+	// 两个方向都结束时返回，任一方向出错时中断另一方向的读取，等其退出后返回，由调用方与 defer 关闭连接
+	errc := make(chan error, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // 结束时中断仍在等待限速的方向
 
 	// Client -> Target
 	go func() {
-		io.Copy(targetConn, conn)
-		done <- true
+		err := copyDirect(ctx, targetConn, conn, throttle.Up, func(n int64) { report(n, 0) })
+		CloseWrite(targetConn) //nolint:errcheck
+		errc <- err
 	}()
 
 	// Target -> Client
 	go func() {
-		io.Copy(conn, targetConn)
-		done <- true
+		err := copyDirect(ctx, conn, targetConn, throttle.Down, func(n int64) { report(0, n) })
+		CloseWrite(conn) //nolint:errcheck
+		errc <- err
 	}()
 
-	<-done
+	if err := <-errc; err != nil {
+		cancel()
+		conn.SetDeadline(time.Now())
+		targetConn.SetDeadline(time.Now())
+	}
+	<-errc
 	log.Printf("[分流] %s 直连已断开: %s", clientAddr, target)
 	return nil
 }
 
+// directReportChunk splice 时每转发这么多字节报告一次
+const directReportChunk = 64 * 1024
+
+// copyDirect 单向转发，通过 report 报告转发的字节数
+//
+// 不限速且两端都是 *net.TCPConn 时按 directReportChunk 分段 io.CopyN，Linux 上走 splice 零拷贝
+// （CopyN 的 *io.LimitedReader 不影响 splice）；其他情况（限速、TUN 的用户态连接）每次写入后报告
+func copyDirect(ctx context.Context, dst, src net.Conn, limiter Limiter, report func(n int64)) error {
+	_, dstTCP := dst.(*net.TCPConn)
+	_, srcTCP := src.(*net.TCPConn)
+	if !limiter.Unlimited() || !dstTCP || !srcTCP {
+		var r io.Reader = src
+		if !limiter.Unlimited() {
+			r = limiter.Reader(ctx, src)
+		}
+		_, err := io.Copy(reportWriter{dst, report}, r)
+		return err
+	}
+	for {
+		n, err := io.CopyN(dst, src, directReportChunk)
+		if n > 0 {
+			report(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// reportWriter 每次写入后报告写入的字节数
+type reportWriter struct {
+	w      io.Writer
+	report func(n int64)
+}
+
+func (w reportWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.report(int64(n))
+	}
+	return n, err
+}
+
+// CloseWrite 关闭连接的写端（TCP 半关闭），不支持半关闭的连接直接关闭
+func CloseWrite(conn io.Writer) error {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	case io.Closer:
+		return c.Close()
+	}
+	return nil
+}
+
 func GetDataByUrl(url string, header map[string]string) (*http.Response, error) {
 	req, _ := http.NewRequest(http.MethodGet, url, nil)
 	for k, v := range header {
@@ -168,18 +254,15 @@ func GetDataByUrl(url string, header map[string]string) (*http.Response, error)
 	return resp, nil
 }
 
-func BuildTLSConfigWithECH(addr string) (*tls.Config, error) {
-	host, _, _, err := ParseServerAddr(addr)
-	if err != nil {
-		return nil, err
-	}
+// BuildTLS13Config 构建连接服务端使用的 TLS 1.3 配置（启用 ECH 时 serverName 为内层 SNI）
+func BuildTLS13Config(serverName string) (*tls.Config, error) {
 	roots, err := x509.SystemCertPool()
 	if err != nil {
 		return nil, fmt.Errorf("加载系统根证书失败: %w", err)
 	}
 	config := &tls.Config{
 		MinVersion: tls.VersionTLS13,
-		ServerName: host,
+		ServerName: serverName,
 		RootCAs:    roots,
 	}
 	return config, nil
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/newde36524/ew/utils/log"
+)
+
+// wrappedConn 隐藏 *net.TCPConn 的具体类型，使 io.Copy 无法使用 splice
+type wrappedConn struct {
+	net.Conn
+}
+
+// BenchmarkDirectRelay 通过 HandleDirectConnection 经本地 TCP 上传数据，比较 splice、用户态复制与限速的开销
+//
+//	go test -run '^$' -bench DirectRelay ./utils
+func BenchmarkDirectRelay(b *testing.B) {
+	log.IsShow = false
+	defer func() { log.IsShow = true }()
+	for _, bc := range []struct {
+		name     string
+		wrap     bool
+		throttle int64 // 上行限速（字节/秒），0 为不限速
+	}{
+		{name: "splice"},
+		{name: "userspace", wrap: true},
+		{name: "throttle-overhead", throttle: 1 << 40}, // 限速远高于实际吞吐，只测令牌桶的开销
+		{name: "throttle-256MB", throttle: 256 << 20},  // 首秒的突发不受限，结果略高于限速
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			benchmarkDirectRelay(b, bc.wrap, bc.throttle)
+		})
+	}
+}
+
+func benchmarkDirectRelay(b *testing.B, wrap bool, throttle int64) {
+	const chunk = 32 * 1024
+
+	// 目标：读取并丢弃所有数据
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer target.Close() //nolint:errcheck
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			received <- 0
+			return
+		}
+		n, _ := io.Copy(io.Discard, conn)
+		conn.Close() //nolint:errcheck
+		received <- n
+	}()
+
+	// 代理入口：把接受的连接交给 HandleDirectConnection
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer proxy.Close() //nolint:errcheck
+	relayDone := make(chan error, 1)
+	go func() {
+		conn, err := proxy.Accept()
+		if err != nil {
+			relayDone <- err
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+		var in net.Conn = conn
+		if wrap {
+			in = wrappedConn{conn}
+		}
+		var t Throttle
+		if throttle > 0 {
+			t.Up = Limiter{NewRateLimiter(throttle)}
+		}
+		err = HandleDirectConnection(in, target.Addr().String(), "bench", ModeHTTPProxy, "", t, nil)
+		relayDone <- err
+	}()
+
+	client, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close() //nolint:errcheck
+
+	buf := make([]byte, chunk)
+	b.SetBytes(chunk)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.(*net.TCPConn).CloseWrite() //nolint:errcheck
+	if n := <-received; n != int64(b.N)*chunk {
+		b.Fatalf("目标收到 %d 字节，应为 %d", n, int64(b.N)*chunk)
+	}
+	b.StopTimer()
+	client.Close() //nolint:errcheck
+	if err := <-relayDone; err != nil {
+		b.Fatal(err)
+	}
+}
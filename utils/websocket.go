@@ -1,85 +1,316 @@
 package utils
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// ErrConnectRejected 服务端返回 ERROR: 拒绝了连接请求（如目标不可达），隧道本身可用
+var ErrConnectRejected = errors.New("服务端拒绝连接")
+
+// tunnelRequestID v2 CONNECT 的请求 ID，用于核对响应
+var tunnelRequestID atomic.Uint32
+
+// 保活：每 wsPingInterval 发送 ping，超过 wsPongWait 没有收到 pong 或任何消息视为对端失效
+const (
+	wsPingInterval = 10 * time.Second
+	wsPongWait     = 30 * time.Second
+	wsWriteWait    = 10 * time.Second
+)
+
+// WebSocketWrap 隧道连接。gorilla/websocket 同一时间只允许一个写入方，
+// 数据与隧道控制消息的写入由 writeMu 串行化；ping 使用可并发的 WriteControl
+//
+// 读取只能在一个协程中进行
 type WebSocketWrap struct {
 	wsConn   *websocket.Conn
+	version  int // 隧道协议版本，见 TunnelV1
+	writeMu  sync.Mutex
 	stopPing chan struct{}
+	close    sync.Once
+	closeErr error
+
+	incoming chan wsMessage // ReadInBackground 后由后台协程读取的消息，读取出错时关闭
+	readErr  error          // 后台读取的错误，incoming 关闭后有效
+	broken   atomic.Bool    // 后台读取已出错，连接不可用
+}
+
+type wsMessage struct {
+	messageType int
+	data        []byte
 }
 
-func NewWebSocketWrap(wsConn *websocket.Conn) *WebSocketWrap {
-	return &WebSocketWrap{
+// NewWebSocketWrap 包装已完成握手的连接，version 为协商的隧道协议版本（见 NegotiatedTunnelVersion）
+//
+// 握手协商了 permessage-deflate 时默认不压缩发送的消息，由 SetCompression 按隧道开启
+func NewWebSocketWrap(wsConn *websocket.Conn, version int) *WebSocketWrap {
+	wsConn.EnableWriteCompression(false)
+	w := &WebSocketWrap{
 		wsConn:   wsConn,
+		version:  version,
 		stopPing: make(chan struct{}),
 	}
+	// pong 在读取协程中处理，需在开始读取前设置
+	wsConn.SetPongHandler(func(string) error {
+		return w.extendReadDeadline()
+	})
+	w.extendReadDeadline() //nolint:errcheck
+	return w
+}
+
+// extendReadDeadline 收到 pong 或消息后延长读超时，只在读取协程中（或开始读取前）调用
+func (w *WebSocketWrap) extendReadDeadline() error {
+	return w.wsConn.SetReadDeadline(time.Now().Add(wsPongWait))
+}
+
+// Version 协商的隧道协议版本
+func (w *WebSocketWrap) Version() int {
+	return w.version
 }
 
+// WriteMessage 发送一个消息，可并发调用
 func (w *WebSocketWrap) WriteMessage(messageType int, data []byte) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
 	return w.wsConn.WriteMessage(messageType, data)
 }
 
 func (w *WebSocketWrap) ReadMessage() (messageType int, p []byte, err error) {
-	return w.wsConn.ReadMessage()
+	if w.incoming != nil {
+		msg, ok := <-w.incoming
+		if !ok {
+			return 0, nil, w.readErr
+		}
+		return msg.messageType, msg.data, nil
+	}
+	messageType, p, err = w.wsConn.ReadMessage()
+	if err == nil {
+		w.extendReadDeadline() //nolint:errcheck
+	}
+	return messageType, p, err
+}
+
+// ReadInBackground 启动后台读取协程，之后 ReadMessage 从该协程取得消息，需在开始读取前调用且只能调用一次
+//
+// 用于连接池中的空闲连接：pong 只在读取时处理，没有读取方时无法延长读超时，也发现不了已失效的连接。
+// 读取出错（如对端关闭、超过 wsPongWait 没有收到 pong）后 Broken 返回 true
+func (w *WebSocketWrap) ReadInBackground() {
+	w.incoming = make(chan wsMessage, 1)
+	go func() {
+		for {
+			mt, p, err := w.wsConn.ReadMessage()
+			if err == nil {
+				w.extendReadDeadline() //nolint:errcheck
+				select {
+				case w.incoming <- wsMessage{messageType: mt, data: p}:
+					continue
+				case <-w.stopPing:
+					err = net.ErrClosed
+				}
+			}
+			w.readErr = err
+			w.broken.Store(true)
+			close(w.incoming)
+			return
+		}
+	}()
+}
+
+// Broken 后台读取是否已出错（见 ReadInBackground）
+func (w *WebSocketWrap) Broken() bool {
+	return w.broken.Load()
+}
+
+// SetCompression 设置之后发送的消息是否压缩，握手未协商 permessage-deflate 时无效
+func (w *WebSocketWrap) SetCompression(enabled bool) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.wsConn.EnableWriteCompression(enabled)
+}
+
+// WriteData 发送隧道数据
+func (w *WebSocketWrap) WriteData(data []byte) error {
+	if w.version < TunnelV2 {
+		return w.WriteMessage(websocket.BinaryMessage, data)
+	}
+	// 帧类型与数据分两次写入同一个消息，避免复制数据；写完整个消息前持有写锁
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	writer, err := w.wsConn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte{frameData}); err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// WriteFin 通知服务端客户端不再发送数据（半关闭），服务端关闭远端连接的写端后继续转发响应；
+// v1 不支持半关闭，等同于 WriteClose
+func (w *WebSocketWrap) WriteFin() error {
+	if w.version < TunnelV2 {
+		return w.WriteClose()
+	}
+	return w.WriteMessage(websocket.BinaryMessage, []byte{frameFin})
+}
+
+// WriteClose 通知服务端关闭远端连接
+func (w *WebSocketWrap) WriteClose() error {
+	if w.version < TunnelV2 {
+		return w.WriteMessage(websocket.TextMessage, []byte("CLOSE"))
+	}
+	return w.WriteMessage(websocket.BinaryMessage, []byte{frameClose})
+}
+
+// ReadData 读取隧道数据，远端不再发送数据（FIN）时返回 io.EOF，服务端中止隧道时返回 ErrTunnelClosed
+func (w *WebSocketWrap) ReadData() ([]byte, error) {
+	for {
+		mt, msg, err := w.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if w.version < TunnelV2 {
+			if mt == websocket.TextMessage {
+				if string(msg) == "CLOSE" {
+					return nil, ErrTunnelClosed
+				}
+				if strings.HasPrefix(string(msg), "ERROR:") {
+					return nil, fmt.Errorf("服务端错误: %s", strings.TrimSpace(strings.TrimPrefix(string(msg), "ERROR:")))
+				}
+			}
+			return msg, nil
+		}
+
+		if mt != websocket.BinaryMessage || len(msg) == 0 {
+			return nil, errBadFrame
+		}
+		switch msg[0] {
+		case frameData:
+			if len(msg) == 1 {
+				continue
+			}
+			return msg[1:], nil
+		case frameFin:
+			return nil, io.EOF
+		case frameClose:
+			return nil, ErrTunnelClosed
+		case frameError:
+			errMsg, _, err := parseControlFrame(msg)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("服务端错误: %s", errMsg)
+		default:
+			return nil, fmt.Errorf("意外的隧道帧: 0x%02x", msg[0])
+		}
+	}
 }
 
+// Close 关闭连接并停止保活，可重复调用
 func (w *WebSocketWrap) Close() error {
-	close(w.stopPing)
-	return w.wsConn.Close()
+	w.close.Do(func() {
+		close(w.stopPing)
+		w.closeErr = w.wsConn.Close()
+	})
+	return w.closeErr
 }
 
+// Ping 发送一个 ping 控制帧，可与读写并发调用
+func (w *WebSocketWrap) Ping(timeout time.Duration) error {
+	return w.wsConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+}
+
+// KeepAlive 定期发送 ping，随 Close 退出；ping 发送失败时关闭连接，使读写方返回
+//
+// pong 的超时检测在读取时进行（见 extendReadDeadline），因此只对正在读取的隧道生效
 func (w *WebSocketWrap) KeepAlive() {
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(wsPingInterval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			w.WriteMessage(websocket.PingMessage, nil) //nolint:errcheck
+			if err := w.Ping(wsWriteWait); err != nil {
+				w.Close() //nolint:errcheck
+				return
+			}
 		case <-w.stopPing:
 			return
 		}
 	}
 }
 
-func (w *WebSocketWrap) Connenct(conn io.ReadWriter, target, firstFrame string, mode int) error {
-	// SOCKS5 不需要在连接时读取首帧数据
-	// 实际的请求数据会在连接建立后通过双向转发传输
+// SendConnect 发送连接请求并等待服务端响应，不向客户端回复；payload 为随请求发送的首包数据
+//
+// 服务端拒绝时错误包装 ErrConnectRejected，其它错误说明隧道本身不可用
+//
+// v1 的 SOCKS5 首包不随 CONNECT 发送：旧版 _worker.js 会把 base64 解码后的二进制数据按文本重新编码而损坏，
+// 改为收到 CONNECTED 后作为普通数据发送（多一次往返，但任何版本的服务端都能正确处理）
+func (w *WebSocketWrap) SendConnect(target string, payload []byte, mode int) error {
+	if w.version >= TunnelV2 {
+		return w.sendConnectV2(target, payload)
+	}
+	if mode == ModeSOCKS5 && len(payload) != 0 {
+		if err := w.SendConnect(target, nil, mode); err != nil {
+			return err
+		}
+		return w.WriteData(payload)
+	}
 
 	// 发送连接请求
-	connectMsg := fmt.Sprintf("CONNECT:%s|%s", target, firstFrame)
-	// 如果是 SOCKS5 模式，添加 base64: 前缀（即使首帧为空也添加前缀）
+	connectMsg := fmt.Sprintf("CONNECT:%s|%s", target, payload)
+	// 如果是 SOCKS5 模式，首帧为二进制数据，使用 base64: 前缀编码（即使首帧为空也添加前缀）
 	if mode == ModeSOCKS5 {
-		connectMsg = fmt.Sprintf("CONNECT:%s|base64:%s", target, firstFrame)
+		connectMsg = fmt.Sprintf("CONNECT:%s|base64:%s", target, base64.StdEncoding.EncodeToString(payload))
 	}
 	if err := w.WriteMessage(websocket.TextMessage, []byte(connectMsg)); err != nil {
-		SendErrorResponse(conn, mode)
 		return err
 	}
 
 	// 等待响应
 	_, msg, err := w.ReadMessage()
 	if err != nil {
-		SendErrorResponse(conn, mode)
 		return err
 	}
 
 	response := string(msg)
 	if strings.HasPrefix(response, "ERROR:") {
-		SendErrorResponse(conn, mode)
-		return errors.New(response)
+		return fmt.Errorf("%w: %s", ErrConnectRejected, strings.TrimSpace(strings.TrimPrefix(response, "ERROR:")))
 	}
 	if response != "CONNECTED" {
-		SendErrorResponse(conn, mode)
 		return fmt.Errorf("意外响应: %s", response)
 	}
+	return nil
+}
 
-	// 发送成功响应（根据模式不同而不同）
-	return SendSuccessResponse(conn, mode)
+func (w *WebSocketWrap) sendConnectV2(target string, payload []byte) error {
+	requestID := tunnelRequestID.Add(1)
+	frame, err := encodeConnectFrame(target, payload, requestID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConnectRejected, err)
+	}
+	if err := w.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		return err
+	}
+
+	mt, msg, err := w.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if mt != websocket.BinaryMessage {
+		return errBadFrame
+	}
+	return parseConnectResponse(msg, requestID)
 }
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestWSServer 启动一个统计收到的消息数的 WebSocket 服务端（ping 由 gorilla 默认回复 pong）
+func newTestWSServer(t *testing.T, received *atomic.Int64) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			received.Add(1)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dialTestWS(t *testing.T, server *httptest.Server) *WebSocketWrap {
+	t.Helper()
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewWebSocketWrap(conn, TunnelV2)
+}
+
+// TestWebSocketWrapConcurrentWrites 并发写入、ping、保活与关闭，配合 -race 检查写入是否串行化
+func TestWebSocketWrapConcurrentWrites(t *testing.T) {
+	var received atomic.Int64
+	server := newTestWSServer(t, &received)
+
+	const writers, messages = 8, 200
+	ws := dialTestWS(t, server)
+	go ws.KeepAlive()
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			if _, err := ws.ReadData(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte(strings.Repeat("x", 100*(i+1)))
+			for j := 0; j < messages; j++ {
+				var err error
+				switch j % 4 {
+				case 0:
+					err = ws.WriteData(payload)
+				case 1:
+					err = ws.WriteMessage(websocket.BinaryMessage, payload)
+				case 2:
+					ws.SetCompression(j%8 == 2)
+					err = ws.WriteData(payload[:1])
+				case 3:
+					err = ws.Ping(time.Second)
+				}
+				if err != nil {
+					t.Errorf("写入失败: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// ping 不计入消息数
+	want := int64(writers * messages * 3 / 4)
+	deadline := time.Now().Add(5 * time.Second)
+	for received.Load() < want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := received.Load(); got != want {
+		t.Errorf("服务端收到 %d 个消息，应为 %d", got, want)
+	}
+
+	ws.Close() //nolint:errcheck
+	<-readDone
+}
+
+// TestWebSocketWrapCloseDuringWrites 写入进行中关闭连接，写入方与读取方都应返回
+func TestWebSocketWrapCloseDuringWrites(t *testing.T) {
+	var received atomic.Int64
+	server := newTestWSServer(t, &received)
+
+	for round := 0; round < 20; round++ {
+		ws := dialTestWS(t, server)
+		go ws.KeepAlive()
+		readDone := make(chan struct{})
+		go func() {
+			defer close(readDone)
+			for {
+				if _, err := ws.ReadData(); err != nil {
+					return
+				}
+			}
+		}()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if ws.WriteData([]byte("data")) != nil || ws.WriteFin() != nil || ws.Ping(time.Second) != nil {
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		for i := 0; i < 3; i++ {
+			go ws.Close() //nolint:errcheck
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			<-readDone
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("关闭后写入或读取未返回")
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/newde36524/ew/utils/log"
+)
+
+// runAPIServer 启动管理 API（不做认证，应只监听本机或内网地址）
+//
+//	GET /stats                              全部统计
+//	GET /stats?period=daily|monthly         按日或按月的统计
+//	GET /stats?period=daily&date=2006-01-02 某一天（按月时为 2006-01）的统计
+func (p *ProxyServer) runAPIServer() error {
+	listener, err := net.Listen("tcp", p.APIAddr)
+	if err != nil {
+		return fmt.Errorf("管理 API 监听失败: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", p.handleStats)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener) //nolint:errcheck
+	log.Printf("[管理] API 启动: http://%s/stats", p.APIAddr)
+	return nil
+}
+
+func (p *ProxyServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := p.stats.Snapshot()
+	query := r.URL.Query()
+	var result any = stats
+	switch period := query.Get("period"); period {
+	case "":
+	case "daily", "monthly":
+		periods := stats.Daily
+		if period == "monthly" {
+			periods = stats.Monthly
+		}
+		result = periods
+		if date := query.Get("date"); len(date) != 0 {
+			usage, ok := periods[date]
+			if !ok {
+				http.Error(w, "no usage for "+date, http.StatusNotFound)
+				return
+			}
+			result = usage
+		}
+	default:
+		http.Error(w, "unknown period: "+period, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result) //nolint:errcheck
+}
+
+// FetchUsageStats 通过管理 API 读取运行中的代理的统计
+func FetchUsageStats(apiAddr string) (UsageStats, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + apiAddr + "/stats")
+	if err != nil {
+		return UsageStats{}, fmt.Errorf("请求管理 API 失败: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return UsageStats{}, fmt.Errorf("管理 API 返回 %s: %s", resp.Status, body)
+	}
+	var stats UsageStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return UsageStats{}, fmt.Errorf("解析统计失败: %w", err)
+	}
+	return stats, nil
+}
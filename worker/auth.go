@@ -0,0 +1,127 @@
+package worker
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/newde36524/ew/utils/log"
+)
+
+// UserAuth SOCKS5 / HTTP 代理的用户名与密码，nil 为不认证
+//
+// 只用于 SOCKS5 与 HTTP 入口；透明代理与 TUN 没有认证信息，不受影响
+type UserAuth map[string]string
+
+// ParseUserAuth 解析 "用户名:密码" 列表（逗号或换行分隔，# 开头的行为注释）
+func ParseUserAuth(s string) (UserAuth, error) {
+	auth := UserAuth{}
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(s, ",", "\n")))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, pass, found := strings.Cut(line, ":")
+		if !found || len(user) == 0 || len(user) > 255 || len(pass) > 255 {
+			return nil, fmt.Errorf("用户格式错误（应为 用户名:密码，各不超过 255 字节）: %s", user)
+		}
+		auth[user] = pass
+	}
+	if len(auth) == 0 {
+		return nil, nil
+	}
+	return auth, nil
+}
+
+// LoadUserAuth 从文件读取用户列表（每行一个 用户名:密码）
+func LoadUserAuth(path string) (UserAuth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取用户文件失败: %w", err)
+	}
+	return ParseUserAuth(string(data))
+}
+
+// verify 校验用户名与密码（常量时间比较密码）
+func (a UserAuth) verify(user, pass string) bool {
+	expected, ok := a[user]
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(pass)) == 1 && ok
+}
+
+// socks5Auth 按 RFC 1928 选择认证方法，需要认证时按 RFC 1929 校验用户名与密码
+func (p *ProxyClient) socks5Auth(methods []byte) bool {
+	if p.auth == nil {
+		_, err := p.Conn.Write([]byte{0x05, 0x00}) // 无需认证
+		return err == nil
+	}
+	if !strings.ContainsRune(string(methods), 0x02) {
+		p.Conn.Write([]byte{0x05, 0xFF}) //nolint:errcheck
+		log.Printf("[认证] %s 客户端不支持用户名/密码认证", p.clientAddr)
+		return false
+	}
+	if _, err := p.Conn.Write([]byte{0x05, 0x02}); err != nil {
+		return false
+	}
+
+	// VER(0x01) | ULEN | UNAME | PLEN | PASSWD
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(p.Conn, header); err != nil || header[0] != 0x01 {
+		return false
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(p.Conn, user); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(p.Conn, header[:1]); err != nil {
+		return false
+	}
+	pass := make([]byte, header[0])
+	if _, err := io.ReadFull(p.Conn, pass); err != nil {
+		return false
+	}
+	if !p.auth.verify(string(user), string(pass)) {
+		p.Conn.Write([]byte{0x01, 0x01}) //nolint:errcheck
+		log.Printf("[认证] %s SOCKS5 用户名或密码错误: %s", p.clientAddr, user)
+		return false
+	}
+	p.user = string(user)
+	_, err := p.Conn.Write([]byte{0x01, 0x00})
+	return err == nil
+}
+
+// httpAuth 校验 Proxy-Authorization（Basic），失败时回复 407
+func (p *ProxyClient) httpAuth(req *http.Request) bool {
+	if p.auth == nil {
+		return true
+	}
+	user, pass, ok := parseProxyAuthorization(req.Header.Get("Proxy-Authorization"))
+	if ok && p.auth.verify(user, pass) {
+		p.user = user
+		return true
+	}
+	if ok {
+		log.Printf("[认证] %s HTTP 用户名或密码错误: %s", p.clientAddr, user)
+	}
+	p.Conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" + //nolint:errcheck
+		"Proxy-Authenticate: Basic realm=\"ew\"\r\nContent-Length: 0\r\n\r\n"))
+	return false
+}
+
+// parseProxyAuthorization 解析 Basic 认证头
+func parseProxyAuthorization(header string) (user, pass string, ok bool) {
+	scheme, credentials, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
@@ -0,0 +1,118 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// runSOCKS5Auth 在管道上执行 socks5Auth，clientMsg 为客户端在方法协商之后发送的数据
+func runSOCKS5Auth(t *testing.T, auth UserAuth, methods []byte, clientMsg []byte) (ok bool, user string, reply []byte) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close() //nolint:errcheck
+	p := &ProxyClient{Conn: server, auth: auth, clientAddr: "127.0.0.1:1"}
+	done := make(chan bool, 1)
+	go func() {
+		done <- p.socks5Auth(methods)
+		server.Close() //nolint:errcheck
+	}()
+	go client.Write(clientMsg) //nolint:errcheck
+	reply, _ = io.ReadAll(client)
+	return <-done, p.user, reply
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	auth := UserAuth{"alice": "secret"}
+	userPass := func(user, pass string) []byte {
+		msg := []byte{0x01, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(pass)))
+		return append(msg, pass...)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		auth    UserAuth
+		methods []byte
+		msg     []byte
+		ok      bool
+		user    string
+		reply   []byte
+	}{
+		{"no auth", nil, []byte{0x00}, nil, true, "", []byte{0x05, 0x00}},
+		{"success", auth, []byte{0x00, 0x02}, userPass("alice", "secret"), true, "alice", []byte{0x05, 0x02, 0x01, 0x00}},
+		{"wrong password", auth, []byte{0x02}, userPass("alice", "nope"), false, "", []byte{0x05, 0x02, 0x01, 0x01}},
+		{"unknown user", auth, []byte{0x02}, userPass("bob", "secret"), false, "", []byte{0x05, 0x02, 0x01, 0x01}},
+		{"method unsupported", auth, []byte{0x00}, nil, false, "", []byte{0x05, 0xFF}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, user, reply := runSOCKS5Auth(t, tc.auth, tc.methods, tc.msg)
+			if ok != tc.ok || user != tc.user || !bytes.Equal(reply, tc.reply) {
+				t.Errorf("socks5Auth = %v, %q, %x；应为 %v, %q, %x", ok, user, reply, tc.ok, tc.user, tc.reply)
+			}
+		})
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	auth := UserAuth{"alice": "secret"}
+	for _, tc := range []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"success", "Basic YWxpY2U6c2VjcmV0", true}, // alice:secret
+		{"wrong password", "Basic YWxpY2U6bm9wZQ==", false},
+		{"missing", "", false},
+		{"other scheme", "Bearer token", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close() //nolint:errcheck
+			p := &ProxyClient{Conn: server, auth: auth, clientAddr: "127.0.0.1:1"}
+			req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+			if len(tc.header) != 0 {
+				req.Header.Set("Proxy-Authorization", tc.header)
+			}
+			done := make(chan bool, 1)
+			go func() {
+				done <- p.httpAuth(req)
+				server.Close() //nolint:errcheck
+			}()
+			resp, err := http.ReadResponse(bufio.NewReader(client), req)
+			ok := <-done
+			if ok != tc.ok {
+				t.Fatalf("httpAuth = %v", ok)
+			}
+			if ok {
+				if err == nil || p.user != "alice" {
+					t.Errorf("认证成功时不应回复，user = %q", p.user)
+				}
+				return
+			}
+			if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || len(resp.Header.Get("Proxy-Authenticate")) == 0 {
+				t.Errorf("应回复 407: %v %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestParseUserAuth(t *testing.T) {
+	auth, err := ParseUserAuth("alice:secret, bob:p:w\n# comment\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auth) != 2 || auth["alice"] != "secret" || auth["bob"] != "p:w" {
+		t.Errorf("ParseUserAuth = %v", auth)
+	}
+	if auth, err := ParseUserAuth(""); auth != nil || err != nil {
+		t.Errorf("空列表应返回 nil: %v, %v", auth, err)
+	}
+	if _, err := ParseUserAuth("alice"); err == nil {
+		t.Error("缺少密码应失败")
+	}
+}
@@ -0,0 +1,158 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/newde36524/ew/utils"
+	"golang.org/x/time/rate"
+)
+
+// BandwidthLimit 上行（客户端 -> 远端）与下行带宽限制，单位字节/秒，0 为不限速
+type BandwidthLimit struct {
+	Up   int64
+	Down int64
+}
+
+// BandwidthConfig 带宽限制，各层级同时生效
+type BandwidthConfig struct {
+	Global BandwidthLimit // 所有连接共享
+	Client BandwidthLimit // 每个客户端 IP 的连接共享
+	User   BandwidthLimit // 每个认证用户的连接共享（未认证的连接不受限）
+	Proxy  BandwidthLimit // 分流到代理的连接共享
+	Direct BandwidthLimit // 分流到直连的连接共享
+}
+
+// ParseBandwidthLimit 解析 "上行/下行" 格式的带宽限制（如 1M/10M），只写一个值时上下行相同
+func ParseBandwidthLimit(s string) (BandwidthLimit, error) {
+	upStr, downStr, found := strings.Cut(s, "/")
+	if !found {
+		downStr = upStr
+	}
+	up, err := utils.ParseBandwidth(upStr)
+	if err != nil {
+		return BandwidthLimit{}, err
+	}
+	down, err := utils.ParseBandwidth(downStr)
+	if err != nil {
+		return BandwidthLimit{}, err
+	}
+	return BandwidthLimit{Up: up, Down: down}, nil
+}
+
+func (l BandwidthLimit) String() string {
+	format := func(v int64) string {
+		if v <= 0 {
+			return "不限"
+		}
+		return fmt.Sprintf("%dKB/s", v>>10)
+	}
+	return format(l.Up) + "/" + format(l.Down)
+}
+
+func (l BandwidthLimit) unlimited() bool {
+	return l.Up <= 0 && l.Down <= 0
+}
+
+type limiterPair struct {
+	up   *rate.Limiter
+	down *rate.Limiter
+}
+
+func newLimiterPair(l BandwidthLimit) limiterPair {
+	return limiterPair{up: utils.NewRateLimiter(l.Up), down: utils.NewRateLimiter(l.Down)}
+}
+
+type keyedLimiter struct {
+	limiterPair
+	refs int // 使用中的连接数，为 0 时移除
+}
+
+// keyedLimiters 按键（客户端 IP、用户名）分配的令牌桶，同一个键的连接共享
+type keyedLimiters struct {
+	limit BandwidthLimit
+	mu    sync.Mutex
+	m     map[string]*keyedLimiter
+}
+
+// acquire 取得 key 的令牌桶，连接结束后调用 release；不限速时返回 false
+func (k *keyedLimiters) acquire(key string) (pair limiterPair, release func(), ok bool) {
+	if k.limit.unlimited() {
+		return limiterPair{}, nil, false
+	}
+	k.mu.Lock()
+	l, found := k.m[key]
+	if !found {
+		l = &keyedLimiter{limiterPair: newLimiterPair(k.limit)}
+		k.m[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+	return l.limiterPair, func() {
+		k.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.m, key)
+		}
+		k.mu.Unlock()
+	}, true
+}
+
+// bandwidthLimiter 按全局、客户端 IP、用户、分流规则分配令牌桶
+type bandwidthLimiter struct {
+	global limiterPair
+	proxy  limiterPair
+	direct limiterPair
+	client keyedLimiters
+	user   keyedLimiters
+}
+
+// newBandwidthLimiter 所有层级都不限速时返回 nil（nil 限速器可安全调用）
+func newBandwidthLimiter(config BandwidthConfig) *bandwidthLimiter {
+	if config.Global.unlimited() && config.Client.unlimited() && config.User.unlimited() &&
+		config.Proxy.unlimited() && config.Direct.unlimited() {
+		return nil
+	}
+	return &bandwidthLimiter{
+		global: newLimiterPair(config.Global),
+		proxy:  newLimiterPair(config.Proxy),
+		direct: newLimiterPair(config.Direct),
+		client: keyedLimiters{limit: config.Client, m: map[string]*keyedLimiter{}},
+		user:   keyedLimiters{limit: config.User, m: map[string]*keyedLimiter{}},
+	}
+}
+
+// throttle 返回一条连接适用的限速器，连接结束后调用 release 释放客户端与用户的令牌桶；
+// user 为认证通过的用户名，未认证时为空
+func (b *bandwidthLimiter) throttle(clientAddr, user string, direct bool) (throttle utils.Throttle, release func()) {
+	if b == nil {
+		return utils.Throttle{}, func() {}
+	}
+	route := b.proxy
+	if direct {
+		route = b.direct
+	}
+	throttle.Up = utils.Limiter{b.global.up, route.up}
+	throttle.Down = utils.Limiter{b.global.down, route.down}
+
+	var releases []func()
+	keys := []struct {
+		limiters *keyedLimiters
+		key      string
+	}{{&b.client, clientIP(clientAddr)}, {&b.user, user}}
+	for _, k := range keys {
+		if len(k.key) == 0 {
+			continue
+		}
+		if pair, rel, ok := k.limiters.acquire(k.key); ok {
+			throttle.Up = append(throttle.Up, pair.up)
+			throttle.Down = append(throttle.Down, pair.down)
+			releases = append(releases, rel)
+		}
+	}
+	return throttle, func() {
+		for _, rel := range releases {
+			rel()
+		}
+	}
+}
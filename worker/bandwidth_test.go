@@ -0,0 +1,26 @@
+package worker
+
+import "testing"
+
+// TestBandwidthUser 同一用户的连接共享令牌桶，全部释放后移除
+func TestBandwidthUser(t *testing.T) {
+	b := newBandwidthLimiter(BandwidthConfig{User: BandwidthLimit{Up: 1 << 20, Down: 1 << 20}})
+	t1, release1 := b.throttle("10.0.0.1:1000", "alice", false)
+	t2, release2 := b.throttle("10.0.0.2:1000", "alice", true)
+	t3, release3 := b.throttle("10.0.0.1:1001", "", false)
+	if len(t1.Up) != 3 || t1.Up[2] != t2.Up[2] {
+		t.Fatalf("同一用户应共享令牌桶: %v %v", t1.Up, t2.Up)
+	}
+	if !t3.Up.Unlimited() {
+		t.Errorf("未认证的连接不受用户限速: %v", t3.Up)
+	}
+	release1()
+	release3()
+	if len(b.user.m) != 1 {
+		t.Errorf("仍有连接时不应移除: %d", len(b.user.m))
+	}
+	release2()
+	if len(b.user.m) != 0 {
+		t.Errorf("全部释放后应移除: %d", len(b.user.m))
+	}
+}
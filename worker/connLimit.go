@@ -0,0 +1,176 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ConnLimitConfig 代理隧道的并发数与新建速率限制（每条隧道对应一次 Worker 请求），0 为不限制
+type ConnLimitConfig struct {
+	MaxTunnels       int           // 全局并发隧道数
+	MaxClientTunnels int           // 每个客户端 IP 的并发隧道数
+	Rate             float64       // 全局每秒新建隧道数
+	ClientRate       float64       // 每个客户端 IP 每秒新建隧道数
+	QueueTimeout     time.Duration // 超出限制时排队等待的最长时间，0 为立即拒绝
+}
+
+var errTunnelLimited = errors.New("隧道数超出限制")
+
+// connLimiterSweepInterval 清理空闲客户端记录的间隔
+const connLimiterSweepInterval = time.Minute
+
+type clientConnLimiter struct {
+	sem  chan struct{} // 并发隧道，nil 为不限制
+	rate *rate.Limiter // 新建速率，nil 为不限制
+	refs int           // 使用中（含排队）的隧道数
+}
+
+// idle 没有使用中的隧道且令牌桶已回满，移除后不影响限速
+func (c *clientConnLimiter) idle() bool {
+	return c.refs == 0 && (c.rate == nil || c.rate.Tokens() >= float64(c.rate.Burst()))
+}
+
+// connLimiter 按全局与客户端 IP 限制隧道并发数与新建速率
+type connLimiter struct {
+	config ConnLimitConfig
+	sem    chan struct{}
+	rate   *rate.Limiter
+
+	mu        sync.Mutex
+	clients   map[string]*clientConnLimiter
+	lastSweep time.Time
+}
+
+// newConnLimiter 不限制时返回 nil（nil 限制器可安全调用）
+func newConnLimiter(config ConnLimitConfig) *connLimiter {
+	if config.MaxTunnels <= 0 && config.MaxClientTunnels <= 0 && config.Rate <= 0 && config.ClientRate <= 0 {
+		return nil
+	}
+	return &connLimiter{
+		config:    config,
+		sem:       newSemaphore(config.MaxTunnels),
+		rate:      newTunnelRate(config.Rate),
+		clients:   map[string]*clientConnLimiter{},
+		lastSweep: time.Now(),
+	}
+}
+
+func newSemaphore(n int) chan struct{} {
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// newTunnelRate 每秒 perSec 个，突发为 1 秒的数量
+func newTunnelRate(perSec float64) *rate.Limiter {
+	if perSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSec), max(int(perSec), 1))
+}
+
+// acquire 为一条新隧道申请名额，超出限制时最多排队 QueueTimeout，仍无名额返回 errTunnelLimited；
+// 成功时隧道结束后需调用 release
+func (l *connLimiter) acquire(clientAddr string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	client, ip := l.client(clientAddr)
+	done := func() {
+		l.mu.Lock()
+		if client.refs--; client.idle() {
+			delete(l.clients, ip)
+		}
+		l.mu.Unlock()
+	}
+
+	ctx := context.Background()
+	if l.config.QueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.config.QueueTimeout)
+		defer cancel()
+	}
+	if !l.waitRate(ctx, client.rate) || !l.waitRate(ctx, l.rate) || !l.enter(ctx, client.sem) {
+		done()
+		return nil, errTunnelLimited
+	}
+	if !l.enter(ctx, l.sem) {
+		leave(client.sem)
+		done()
+		return nil, errTunnelLimited
+	}
+	return func() {
+		leave(l.sem)
+		leave(client.sem)
+		done()
+	}, nil
+}
+
+// client 取得客户端 IP 的限制器并增加引用
+func (l *connLimiter) client(clientAddr string) (*clientConnLimiter, string) {
+	ip := clientIP(clientAddr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// 令牌桶未回满的客户端在释放时不会移除，定期清理
+	if time.Since(l.lastSweep) > connLimiterSweepInterval {
+		l.lastSweep = time.Now()
+		for key, c := range l.clients {
+			if c.idle() {
+				delete(l.clients, key)
+			}
+		}
+	}
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientConnLimiter{
+			sem:  newSemaphore(l.config.MaxClientTunnels),
+			rate: newTunnelRate(l.config.ClientRate),
+		}
+		l.clients[ip] = client
+	}
+	client.refs++
+	return client, ip
+}
+
+// waitRate 取一个新建隧道的令牌，不排队时只尝试一次
+func (l *connLimiter) waitRate(ctx context.Context, limiter *rate.Limiter) bool {
+	if limiter == nil {
+		return true
+	}
+	if l.config.QueueTimeout <= 0 {
+		return limiter.Allow()
+	}
+	return limiter.Wait(ctx) == nil
+}
+
+// enter 占用一个并发名额，不排队时只尝试一次
+func (l *connLimiter) enter(ctx context.Context, sem chan struct{}) bool {
+	if sem == nil {
+		return true
+	}
+	if l.config.QueueTimeout <= 0 {
+		select {
+		case sem <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func leave(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
@@ -1,5 +1,7 @@
 package worker
 
+import "time"
+
 type RoutingMode = string
 
 const (
@@ -7,3 +9,12 @@ const (
 	Global   RoutingMode = "global"
 	BypassCN RoutingMode = "bypass_cn"
 )
+
+// proxiedDoHHost 代理域名经 ECH 隧道查询时使用的 DoH 服务器
+const proxiedDoHHost = "cloudflare-dns.com"
+
+// SOCKS5 首包（0-RTT）：回复成功后等待客户端首包的时间与随 CONNECT 发送的最大长度
+const (
+	earlyDataTimeout = 50 * time.Millisecond
+	earlyDataSize    = 16 * 1024
+)
@@ -1,118 +1,383 @@
 package worker
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/newde36524/ew/utils/log"
 
-	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/newde36524/ew/utils"
 )
 
+const (
+	echMinRefresh   = time.Minute      // 按 TTL 刷新的最短间隔
+	echMaxRefresh   = 24 * time.Hour   // 按 TTL 刷新的最长间隔
+	echRetryRefresh = 30 * time.Second // 刷新失败后的重试间隔
+	echRefreshGap   = 5 * time.Second  // 两次刷新的最短间隔，避免连接失败时集中刷新
+
+	echConfigVersion = 0xfe0d // 标准库支持的 ECHConfig 版本
+)
+
 type Ech struct {
-	dnsServer string
-	echDomain string
-	echListMu sync.RWMutex
-	echList   []byte
-	tlsConfig utils.Store[*tls.Config]
+	name       string // 配置来源标识（查询域名或文件路径），用于日志与缓存文件
+	kind       string // 配置来源类型：EchSourceDNS / EchSourceStatic / EchSourceFile
+	load       func() (configList []byte, ttl uint32, err error)
+	PublicName string // 仅使用 public_name（外层 SNI）与之匹配的 ECHConfig，为空则不限制
+
+	state     atomic.Pointer[echState]
+	refreshMu sync.Mutex  // 合并并发的刷新请求
+	timer     *time.Timer // 按 TTL 刷新的定时器，由 refreshMu 保护
+	queriedAt time.Time   // 最近一次查询的时间，由 refreshMu 保护
 }
 
-func NewEch(dnsServer, echDomain string) *Ech {
+// ECH 配置来源
+const (
+	EchSourceDNS    = "dns"    // DNS 查询
+	EchSourceStatic = "static" // 固定配置
+	EchSourceFile   = "file"   // 配置文件
+	EchSourceCache  = "cache"  // 本地缓存文件（DNS 不可用时）
+	EchSourceRetry  = "retry"  // 服务器拒绝 ECH 时提供的重试配置
+)
+
+// echState 一次查询得到的 ECH 配置及由其构建的 TLS 配置，刷新时整体替换
+type echState struct {
+	echList    []byte
+	source     string
+	fetchedAt  time.Time
+	ttl        time.Duration
+	tlsConfigs sync.Map // serverName -> *tls.Config
+}
+
+// EchStatus ECH 配置状态
+type EchStatus struct {
+	Source    string
+	FetchedAt time.Time
+	TTL       time.Duration
+	Length    int
+	Stale     bool // 来自缓存文件或已超过 TTL
+}
+
+func (s EchStatus) String() string {
+	status := fmt.Sprintf("来源: %s，长度: %d 字节，获取于 %s", s.Source, s.Length, s.FetchedAt.Format(time.DateTime))
+	if s.TTL > 0 {
+		status += fmt.Sprintf("，TTL: %v", s.TTL)
+	}
+	if s.Stale {
+		status += "（已过期）"
+	}
+	return status
+}
+
+// NewEch 通过 DNS 查询 echDomain 的 HTTPS 记录获取 ECH 配置，按记录 TTL 刷新
+func NewEch(dns utils.DNSExchanger, echDomain string) *Ech {
 	return &Ech{
-		dnsServer: dnsServer,
-		echDomain: echDomain,
+		name: echDomain,
+		kind: EchSourceDNS,
+		load: func() ([]byte, uint32, error) {
+			raw, ttl, err := utils.QueryHTTPSRecord(dns.Exchange, echDomain)
+			if err != nil {
+				return nil, 0, fmt.Errorf("DNS 查询失败: %w", err)
+			}
+			return raw, ttl, nil
+		},
+	}
+}
+
+// NewStaticEch 使用固定的 ECHConfigList（base64）
+func NewStaticEch(configList string) (*Ech, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(configList))
+	if err != nil {
+		return nil, fmt.Errorf("ECH 配置解码失败: %w", err)
 	}
+	return &Ech{
+		name: EchSourceStatic,
+		kind: EchSourceStatic,
+		load: func() ([]byte, uint32, error) {
+			return raw, 0, nil
+		},
+	}, nil
+}
+
+// NewFileEch 从文件读取 ECHConfigList（base64 文本或二进制），刷新时重新读取
+func NewFileEch(path string) *Ech {
+	return &Ech{
+		name: path,
+		kind: EchSourceFile,
+		load: func() ([]byte, uint32, error) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, 0, fmt.Errorf("读取 ECH 配置文件失败: %w", err)
+			}
+			if raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+				return raw, 0, nil
+			}
+			return data, 0, nil
+		},
+	}
+}
+
+// Query 直接从配置来源（DNS、固定配置或文件）获取 ECH 配置，失败时不使用缓存文件，用于诊断
+func (e *Ech) Query() error {
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+	e.queriedAt = time.Now()
+	return e.queryLocked()
 }
 
 func (e *Ech) PrepareECH() error {
-	echBase64, err := utils.QueryHTTPSRecord(e.echDomain, e.dnsServer)
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+	return e.prepareLocked()
+}
+
+func (e *Ech) prepareLocked() error {
+	e.queriedAt = time.Now()
+	err := e.queryLocked()
+	if err == nil {
+		return nil
+	}
+	e.scheduleLocked(echRetryRefresh)
+	if e.state.Load() != nil {
+		return err
+	}
+
+	// 尚无可用配置（启动时），尝试使用上次保存的缓存
+	if e.kind != EchSourceDNS {
+		return err
+	}
+	entry, cacheErr := loadECHCache(e.name)
+	if cacheErr != nil {
+		return err
+	}
+	list, cacheErr := filterECHConfigList(entry.ConfigList, e.PublicName)
+	if cacheErr != nil {
+		return err
+	}
+	e.state.Store(&echState{
+		echList:   list,
+		source:    EchSourceCache,
+		fetchedAt: entry.FetchedAt,
+		ttl:       time.Duration(entry.TTL) * time.Second,
+	})
+	log.Printf("[ECH] %s: %v，使用缓存配置（获取于 %s，已过期），%v 后重试", e.name, err, entry.FetchedAt.Format(time.DateTime), echRetryRefresh)
+	return nil
+}
+
+// queryLocked 从配置来源获取 ECH 配置，成功后替换快照；DNS 来源的配置同时保存到缓存文件
+func (e *Ech) queryLocked() error {
+	raw, ttl, err := e.load()
 	if err != nil {
-		return fmt.Errorf("DNS 查询失败: %w", err)
+		return err
 	}
-	if len(echBase64) == 0 {
+	if len(raw) == 0 {
 		return errors.New("未找到 ECH 参数")
 	}
-	raw, err := base64.StdEncoding.DecodeString(echBase64)
-	if err != nil {
-		return fmt.Errorf("ECH 解码失败: %w", err)
+	if raw, err = filterECHConfigList(raw, e.PublicName); err != nil {
+		return fmt.Errorf("ECH 配置无效: %w", err)
+	}
+	// 替换整个快照：旧的 TLS 配置随之失效，新建立的连接使用新配置
+	state := &echState{
+		echList:   raw,
+		source:    e.kind,
+		fetchedAt: time.Now(),
+		ttl:       time.Duration(ttl) * time.Second,
 	}
-	e.echListMu.Lock()
-	e.echList = raw
-	e.echListMu.Unlock()
-	log.Printf("[ECH] 配置已加载，长度: %d 字节", len(raw))
+	e.state.Store(state)
+	e.persist(state)
+	// 固定配置与文件没有 TTL，只在连接失败时重新读取
+	if state.ttl == 0 {
+		log.Printf("[ECH] %s 配置已加载，长度: %d 字节", e.name, len(raw))
+		return nil
+	}
+	interval := min(max(state.ttl, echMinRefresh), echMaxRefresh)
+	e.scheduleLocked(interval)
+	log.Printf("[ECH] %s 配置已加载，长度: %d 字节，%v 后刷新", e.name, len(raw), interval)
 	return nil
 }
 
-func (e *Ech) RefreshECH() error {
-	log.Printf("[ECH] 刷新配置...")
-	return e.PrepareECH()
+// persist 将 DNS 来源的配置保存到缓存文件
+func (e *Ech) persist(state *echState) {
+	if e.kind != EchSourceDNS {
+		return
+	}
+	err := saveECHCache(e.name, &echCacheEntry{
+		ConfigList: state.echList,
+		FetchedAt:  state.fetchedAt,
+		TTL:        int64(state.ttl / time.Second),
+	})
+	if err != nil {
+		log.Printf("[ECH] %v", err)
+	}
 }
 
-func (e *Ech) GetECHList() ([]byte, error) {
-	e.echListMu.RLock()
-	defer e.echListMu.RUnlock()
-	if len(e.echList) == 0 {
-		return nil, errors.New("ECH 配置未加载")
+// Status 返回当前 ECH 配置的状态
+func (e *Ech) Status() (EchStatus, bool) {
+	state := e.state.Load()
+	if state == nil {
+		return EchStatus{}, false
 	}
-	return e.echList, nil
+	return EchStatus{
+		Source:    state.source,
+		FetchedAt: state.fetchedAt,
+		TTL:       state.ttl,
+		Length:    len(state.echList),
+		Stale:     state.source == EchSourceCache || (state.ttl > 0 && time.Since(state.fetchedAt) > state.ttl),
+	}, true
 }
 
-func (e *Ech) BuildTLSConfigWithECH(serverName string, echList []byte) (*tls.Config, error) {
-	if len(echList) == 0 {
-		return nil, errors.New("ECH 配置为空，这是必需功能")
+// scheduleLocked 重置刷新定时器
+func (e *Ech) scheduleLocked(d time.Duration) {
+	if e.timer != nil {
+		e.timer.Stop()
 	}
-	// 尝试从缓存获取
-	return e.tlsConfig.GetOrStore(func() (*tls.Config, error) {
-		config, err := utils.BuildTLSConfigWithECH(serverName)
-		if err != nil {
-			return nil, err
-		}
-		// 使用反射设置 ECH 字段（ECH 是核心功能，必须设置成功）
-		if err := e.setECHConfig(config, echList); err != nil {
-			return nil, fmt.Errorf("设置 ECH 配置失败（需要 Go 1.23+ 或支持 ECH 的版本）: %w", err)
+	e.timer = time.AfterFunc(d, func() {
+		if err := e.RefreshECH(); err != nil {
+			log.Printf("[ECH] 定时刷新失败，继续使用旧配置: %v", err)
 		}
-		return config, nil
 	})
 }
 
-// setECHConfig 使用反射设置 ECH 配置（ECH 是核心功能，必须成功）
-func (e *Ech) setECHConfig(config *tls.Config, echList []byte) error {
-	configValue := reflect.ValueOf(config).Elem()
+// RefreshECH 重新查询 ECH 配置，短时间内的重复调用只会触发一次查询
+func (e *Ech) RefreshECH() error {
+	old := e.state.Load()
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+	if e.state.Load() != old || time.Since(e.queriedAt) < echRefreshGap {
+		return nil // 等待期间已被其它调用刷新，或刚刚刷新过
+	}
+	log.Printf("[ECH] 刷新配置: %s", e.name)
+	return e.prepareLocked()
+}
 
-	// 设置 EncryptedClientHelloConfigList（必需）
-	field1 := configValue.FieldByName("EncryptedClientHelloConfigList")
-	if !field1.IsValid() || !field1.CanSet() {
-		return fmt.Errorf("EncryptedClientHelloConfigList 字段不可用，需要 Go 1.23+ 版本")
+// HandleRejection 处理服务器拒绝 ECH 的握手错误
+//
+// 标准库已按 ECH 配置中的 public_name 验证过服务器证书，其中的 retry_configs 可信，
+// 直接替换当前配置而无需重新查询 DNS。返回是否已替换（可立即重连）
+func (e *Ech) HandleRejection(err error) bool {
+	retryConfigs, rejected := echRejection(err)
+	if !rejected {
+		return false
+	}
+	if len(retryConfigs) == 0 {
+		log.Printf("[ECH] 服务器拒绝 ECH，且未提供重试配置")
+		return false
+	}
+	list, err := filterECHConfigList(retryConfigs, e.PublicName)
+	if err != nil {
+		log.Printf("[ECH] 服务器提供的重试配置无效: %v", err)
+		return false
 	}
-	field1.Set(reflect.ValueOf(echList))
 
-	// 设置 EncryptedClientHelloRejectionVerify（必需）
-	field2 := configValue.FieldByName("EncryptedClientHelloRejectionVerify")
-	if !field2.IsValid() || !field2.CanSet() {
-		return fmt.Errorf("EncryptedClientHelloRejectionVerify 字段不可用，需要 Go 1.23+ 版本")
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+	if state := e.state.Load(); state == nil || !bytes.Equal(state.echList, list) {
+		retry := &echState{
+			echList:   list,
+			source:    EchSourceRetry,
+			fetchedAt: time.Now(),
+			ttl:       echMinRefresh,
+		}
+		if state != nil && state.ttl > retry.ttl {
+			retry.ttl = state.ttl
+		}
+		e.state.Store(retry)
+		e.persist(retry)
+		log.Printf("[ECH] 服务器拒绝 ECH，已改用其提供的重试配置，长度: %d 字节", len(list))
 	}
-	rejectionFunc := func(cs tls.ConnectionState) error {
-		return errors.New("服务器拒绝 ECH")
+	return true
+}
+
+// validateECHConfigList 检查 ECHConfigList 结构
+func validateECHConfigList(list []byte) error {
+	_, err := filterECHConfigList(list, "")
+	return err
+}
+
+// filterECHConfigList 检查 ECHConfigList 结构并只保留支持的版本，
+// publicName 不为空时只保留 public_name 与之相同的配置
+func filterECHConfigList(list []byte, publicName string) ([]byte, error) {
+	configs, err := ParseECHConfigList(list)
+	if err != nil {
+		return nil, err
+	}
+	filtered := []byte{0, 0}
+	for _, config := range configs {
+		if config.Version != echConfigVersion {
+			continue
+		}
+		if len(publicName) != 0 && !strings.EqualFold(config.PublicName, publicName) {
+			continue
+		}
+		filtered = append(filtered, config.Raw...)
+	}
+	if len(filtered) == 2 {
+		if len(publicName) != 0 {
+			return nil, fmt.Errorf("没有 public_name 为 %s 的 ECHConfig", publicName)
+		}
+		return nil, errors.New("没有支持的 ECHConfig 版本")
 	}
-	field2.Set(reflect.ValueOf(rejectionFunc))
+	binary.BigEndian.PutUint16(filtered, uint16(len(filtered)-2))
+	return filtered, nil
+}
 
-	return nil
+func (e *Ech) GetECHList() ([]byte, error) {
+	state := e.state.Load()
+	if state == nil {
+		return nil, errors.New("ECH 配置未加载")
+	}
+	return state.echList, nil
 }
 
-func (e *Ech) GetTlsCfg() (*tls.Config, error) {
-	echBytes, err := e.GetECHList()
+// BuildTLSConfigWithECH 使用指定的 ECH 配置构建 TLS 配置（不缓存）
+//
+// 不设置 EncryptedClientHelloRejectionVerify：ECH 被拒绝时由标准库按 public_name 验证证书，
+// 验证通过后返回携带 retry_configs 的 ECHRejectionError，见 echRejection
+func (e *Ech) BuildTLSConfigWithECH(serverName string, echList []byte) (*tls.Config, error) {
+	if len(echList) == 0 {
+		return nil, errors.New("ECH 配置为空")
+	}
+	config, err := utils.BuildTLS13Config(serverName)
 	if err != nil {
-		return nil, fmt.Errorf("获取 ECH 配置失败: %w", err)
+		return nil, err
+	}
+	config.EncryptedClientHelloConfigList = echList
+	return config, nil
+}
+
+// echRejection 判断握手错误是否为服务器拒绝 ECH，并返回其提供的重试配置
+func echRejection(err error) (retryConfigs []byte, rejected bool) {
+	var rejection *tls.ECHRejectionError
+	if !errors.As(err, &rejection) {
+		return nil, false
 	}
+	return rejection.RetryConfigList, true
+}
 
-	tlsCfg, err := e.BuildTLSConfigWithECH("cloudflare-dns.com", echBytes)
+// GetTlsCfg 返回以 serverName 为内层 SNI 的 ECH TLS 配置（外层 SNI 为 ECHConfig 的 public_name）
+//
+// 配置取自当前快照并按服务器名缓存，ECH 刷新后自动使用新配置
+func (e *Ech) GetTlsCfg(serverName string) (*tls.Config, error) {
+	state := e.state.Load()
+	if state == nil {
+		return nil, errors.New("获取 ECH 配置失败: ECH 配置未加载")
+	}
+	if config, ok := state.tlsConfigs.Load(serverName); ok {
+		return config.(*tls.Config), nil
+	}
+	tlsCfg, err := e.BuildTLSConfigWithECH(serverName, state.echList)
 	if err != nil {
 		return nil, fmt.Errorf("构建 TLS 配置失败: %w", err)
 	}
-	return tlsCfg, nil
+	actual, _ := state.tlsConfigs.LoadOrStore(serverName, tlsCfg)
+	return actual.(*tls.Config), nil
 }
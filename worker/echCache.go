@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/newde36524/ew/utils"
+)
+
+// echCacheFile ECH 配置缓存文件（与可执行文件同目录），DoH 不可用时用于启动
+const echCacheFile = "ech_cache.json"
+
+// echCacheEntry 缓存文件中一个查询域名的记录
+type echCacheEntry struct {
+	ConfigList []byte    `json:"config_list"` // ECHConfigList（JSON 中为 base64）
+	FetchedAt  time.Time `json:"fetched_at"`
+	TTL        int64     `json:"ttl"` // 秒
+}
+
+// loadECHCache 读取指定域名的缓存记录
+func loadECHCache(domain string) (*echCacheEntry, error) {
+	path, err := utils.ExeFilePath(echCacheFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]*echCacheEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("解析 ECH 缓存失败: %w", err)
+	}
+	entry, ok := entries[domain]
+	if !ok || len(entry.ConfigList) == 0 {
+		return nil, fmt.Errorf("ECH 缓存中没有 %s 的记录", domain)
+	}
+	if err := validateECHConfigList(entry.ConfigList); err != nil {
+		return nil, fmt.Errorf("ECH 缓存无效: %w", err)
+	}
+	return entry, nil
+}
+
+// saveECHCache 保存指定域名的缓存记录（保留其它域名的记录）
+func saveECHCache(domain string, entry *echCacheEntry) error {
+	path, err := utils.ExeFilePath(echCacheFile)
+	if err != nil {
+		return err
+	}
+	entries := map[string]*echCacheEntry{}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &entries) //nolint:errcheck
+	}
+	entries[domain] = entry
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再替换，避免写入中断导致缓存损坏
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("保存 ECH 缓存失败: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("保存 ECH 缓存失败: %w", err)
+	}
+	return nil
+}
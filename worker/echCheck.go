@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/newde36524/ew/utils"
+)
+
+const echCheckTimeout = 10 * time.Second
+
+// CheckECH 诊断服务端的 ECH：获取并打印 ECH 配置，再进行一次测试握手，
+// 报告 ECH 被接受、被拒绝（以及重试配置是否可用）或未协商
+func CheckECH(server *ProxyClientConfig, w io.Writer) error {
+	fmt.Fprintf(w, "== 服务端 %s（SNI: %s，ECH 策略: %s）\n", server.ServerAddr, server.SNI, server.ECHPolicy)
+	if !server.ECHPolicy.useECH() {
+		fmt.Fprintf(w, "结果: 不使用 ECH，跳过检查\n")
+		return nil
+	}
+	// 诊断的是当前 DNS 返回的配置，不退回启动时使用的缓存文件
+	if err := server.Ech.Query(); err != nil {
+		fmt.Fprintf(w, "获取 ECH 配置失败（未使用缓存）: %v\n", err)
+		return err
+	}
+	status, _ := server.Ech.Status()
+	fmt.Fprintf(w, "ECH 配置 %s\n", status)
+	list, err := server.Ech.GetECHList()
+	if err != nil {
+		return err
+	}
+	printECHConfigList(w, list)
+
+	tlsCfg, err := server.Ech.GetTlsCfg(server.SNI)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "测试握手...\n")
+	state, err := checkHandshake(server, tlsCfg.Clone())
+
+	retryConfigs, rejected := echRejection(err)
+	switch {
+	case err == nil && state.ECHAccepted:
+		fmt.Fprintf(w, "结果: ECH 已接受（外层 SNI 已加密，内层 SNI: %s）\n", state.ServerName)
+		return nil
+	case err == nil:
+		fmt.Fprintf(w, "结果: 握手成功，但未协商 ECH\n")
+		return errors.New("未协商 ECH")
+	case rejected && len(retryConfigs) == 0:
+		fmt.Fprintf(w, "结果: ECH 被拒绝，服务器未提供重试配置（服务器可能未启用 ECH）\n")
+		return err
+	case rejected:
+		fmt.Fprintf(w, "结果: ECH 被拒绝，服务器提供了重试配置:\n")
+		printECHConfigList(w, retryConfigs)
+	default:
+		fmt.Fprintf(w, "结果: 握手失败: %v\n", err)
+		return err
+	}
+
+	// 使用重试配置再握手一次，确认本地配置是否只是过期
+	retryCfg := tlsCfg.Clone()
+	retryCfg.EncryptedClientHelloConfigList = retryConfigs
+	fmt.Fprintf(w, "使用重试配置测试握手...\n")
+	rejectErr := err
+	state, err = checkHandshake(server, retryCfg)
+	switch {
+	case err == nil && state.ECHAccepted:
+		fmt.Fprintf(w, "结果: 使用重试配置后 ECH 已接受（本地配置已过期，运行时会自动替换）\n")
+	case err == nil:
+		fmt.Fprintf(w, "结果: 使用重试配置握手成功，但未协商 ECH\n")
+	default:
+		fmt.Fprintf(w, "结果: 使用重试配置握手失败: %v\n", err)
+	}
+	return rejectErr
+}
+
+// checkHandshake 连接服务端（或固定 IP）并完成 TLS 握手
+func checkHandshake(server *ProxyClientConfig, tlsCfg *tls.Config) (tls.ConnectionState, error) {
+	host, port, _, err := utils.ParseServerAddr(server.ServerAddr)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	if len(server.ServerIP) != 0 {
+		host = server.ServerIP
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), echCheckTimeout)
+	defer cancel()
+
+	rawConn, err := utils.NewDialer(echCheckTimeout).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer rawConn.Close() //nolint:errcheck
+	conn := tls.Client(rawConn, tlsCfg)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return conn.ConnectionState(), nil
+}
+
+func printECHConfigList(w io.Writer, list []byte) {
+	configs, err := ParseECHConfigList(list)
+	if err != nil {
+		fmt.Fprintf(w, "ECHConfigList 解析失败: %v\n", err)
+		return
+	}
+	for i, config := range configs {
+		fmt.Fprintf(w, "ECHConfig #%d %s\n", i+1, config)
+	}
+}
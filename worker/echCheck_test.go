@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testECHConfigList 构造只含一个 ECHConfig 的 ECHConfigList（X25519、HKDF-SHA256、AES-128-GCM）
+func testECHConfigList(publicName string) []byte {
+	contents := []byte{0x01, 0x00, 0x20} // config_id, kem_id
+	contents = binary.BigEndian.AppendUint16(contents, 32)
+	contents = append(contents, make([]byte, 32)...)
+	contents = append(contents, 0x00, 0x04, 0x00, 0x01, 0x00, 0x01) // cipher_suites
+	contents = append(contents, 0, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = append(contents, 0x00, 0x00) // extensions
+
+	config := binary.BigEndian.AppendUint16(nil, echConfigVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(config))), config...)
+}
+
+// TestCheckECHLiveQuery ech-check 打印实时查询的来源与 TTL，查询失败时报错而不使用缓存文件
+func TestCheckECHLiveQuery(t *testing.T) {
+	const domain = "ech-check.test.invalid"
+	list := testECHConfigList("cloudflare-ech.com")
+	if err := saveECHCache(domain, &echCacheEntry{ConfigList: list, FetchedAt: time.Now(), TTL: 300}); err != nil {
+		t.Fatal(err)
+	}
+
+	queryErr := errors.New("DNS 查询失败")
+	ech := &Ech{name: domain, kind: EchSourceDNS, load: func() ([]byte, uint32, error) {
+		if queryErr != nil {
+			return nil, 0, queryErr
+		}
+		return list, 600, nil
+	}}
+	server := &ProxyClientConfig{ServerAddr: "127.0.0.1:1", SNI: "example.com", ECHPolicy: ECHRequired, Ech: ech}
+
+	// 启动时 DNS 不可用会退回缓存（PrepareECH），诊断时不会
+	var out bytes.Buffer
+	if err := CheckECH(server, &out); !errors.Is(err, queryErr) {
+		t.Fatalf("CheckECH = %v，应为查询错误\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "未使用缓存") {
+		t.Errorf("输出应说明未使用缓存:\n%s", out.String())
+	}
+
+	queryErr = nil
+	out.Reset()
+	CheckECH(server, &out) //nolint:errcheck // 握手失败（127.0.0.1:1 无服务）
+	if !strings.Contains(out.String(), "来源: dns") || !strings.Contains(out.String(), "TTL: 10m0s") {
+		t.Errorf("输出应包含来源与 TTL:\n%s", out.String())
+	}
+}
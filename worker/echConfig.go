@@ -0,0 +1,169 @@
+package worker
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ECHConfig 解析后的 ECHConfig（draft-ietf-tls-esni 第 4 节）
+type ECHConfig struct {
+	Version       uint16
+	ConfigID      uint8
+	KEMID         uint16
+	PublicKey     []byte
+	CipherSuites  []ECHCipherSuite
+	MaxNameLength uint8
+	PublicName    string
+	Extensions    []ECHExtension
+	Raw           []byte // 完整的 ECHConfig（含 version 与 length）
+}
+
+// ECHCipherSuite HPKE 对称算法组合
+type ECHCipherSuite struct {
+	KDFID  uint16
+	AEADID uint16
+}
+
+// ECHExtension ECHConfig 扩展
+type ECHExtension struct {
+	Type uint16
+	Data []byte
+}
+
+// HPKE 算法名称（RFC 9180）
+var (
+	hpkeKEMNames = map[uint16]string{
+		0x0010: "DHKEM(P-256, HKDF-SHA256)",
+		0x0011: "DHKEM(P-384, HKDF-SHA384)",
+		0x0012: "DHKEM(P-521, HKDF-SHA512)",
+		0x0020: "DHKEM(X25519, HKDF-SHA256)",
+		0x0021: "DHKEM(X448, HKDF-SHA512)",
+	}
+	hpkeKDFNames = map[uint16]string{
+		0x0001: "HKDF-SHA256",
+		0x0002: "HKDF-SHA384",
+		0x0003: "HKDF-SHA512",
+	}
+	hpkeAEADNames = map[uint16]string{
+		0x0001: "AES-128-GCM",
+		0x0002: "AES-256-GCM",
+		0x0003: "ChaCha20Poly1305",
+	}
+)
+
+func hpkeName(names map[uint16]string, id uint16) string {
+	if name, ok := names[id]; ok {
+		return fmt.Sprintf("%s (0x%04x)", name, id)
+	}
+	return fmt.Sprintf("未知 (0x%04x)", id)
+}
+
+func (c ECHConfig) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "version: 0x%04x", c.Version)
+	if c.Version != echConfigVersion {
+		b.WriteString("（不支持的版本，未解析）")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\n  config_id: %d", c.ConfigID)
+	fmt.Fprintf(&b, "\n  kem: %s", hpkeName(hpkeKEMNames, c.KEMID))
+	fmt.Fprintf(&b, "\n  public_key: %d 字节", len(c.PublicKey))
+	for _, suite := range c.CipherSuites {
+		fmt.Fprintf(&b, "\n  cipher_suite: %s / %s", hpkeName(hpkeKDFNames, suite.KDFID), hpkeName(hpkeAEADNames, suite.AEADID))
+	}
+	fmt.Fprintf(&b, "\n  public_name: %s", c.PublicName)
+	fmt.Fprintf(&b, "\n  maximum_name_length: %d", c.MaxNameLength)
+	if len(c.Extensions) == 0 {
+		b.WriteString("\n  extensions: 无")
+	}
+	for _, ext := range c.Extensions {
+		fmt.Fprintf(&b, "\n  extension: 0x%04x (%d 字节)", ext.Type, len(ext.Data))
+	}
+	return b.String()
+}
+
+// ParseECHConfigList 解析 ECHConfigList：2 字节总长度，后跟若干 ECHConfig{version(2), length(2), contents}
+// 不支持的版本只保留 Version 与 Raw
+func ParseECHConfigList(list []byte) ([]ECHConfig, error) {
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, errors.New("长度不匹配")
+	}
+	var configs []ECHConfig
+	for rest := list[2:]; len(rest) != 0; {
+		if len(rest) < 4 {
+			return nil, errors.New("ECHConfig 不完整")
+		}
+		length := int(binary.BigEndian.Uint16(rest[2:]))
+		if len(rest) < 4+length {
+			return nil, errors.New("ECHConfig 不完整")
+		}
+		config := ECHConfig{
+			Version: binary.BigEndian.Uint16(rest),
+			Raw:     rest[:4+length],
+		}
+		if config.Version == echConfigVersion {
+			if err := config.parseContents(rest[4 : 4+length]); err != nil {
+				return nil, err
+			}
+		}
+		configs = append(configs, config)
+		rest = rest[4+length:]
+	}
+	return configs, nil
+}
+
+// parseContents 解析 ECHConfigContents：
+// key_config{config_id(1), kem_id(2), public_key<2>, cipher_suites<2>}, maximum_name_length(1), public_name<1>, extensions<2>
+func (c *ECHConfig) parseContents(b []byte) error {
+	errIncomplete := errors.New("ECHConfig 不完整")
+	readVector := func(b []byte) ([]byte, []byte, bool) {
+		if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+			return nil, nil, false
+		}
+		n := 2 + int(binary.BigEndian.Uint16(b))
+		return b[2:n], b[n:], true
+	}
+
+	if len(b) < 3 {
+		return errIncomplete
+	}
+	c.ConfigID = b[0]
+	c.KEMID = binary.BigEndian.Uint16(b[1:])
+	var suites []byte
+	var ok bool
+	if c.PublicKey, b, ok = readVector(b[3:]); !ok {
+		return errIncomplete
+	}
+	if suites, b, ok = readVector(b); !ok || len(suites)%4 != 0 {
+		return errIncomplete
+	}
+	for ; len(suites) != 0; suites = suites[4:] {
+		c.CipherSuites = append(c.CipherSuites, ECHCipherSuite{
+			KDFID:  binary.BigEndian.Uint16(suites),
+			AEADID: binary.BigEndian.Uint16(suites[2:]),
+		})
+	}
+	if len(b) < 2 || len(b) < 2+int(b[1]) {
+		return errIncomplete
+	}
+	c.MaxNameLength = b[0]
+	c.PublicName = string(b[2 : 2+int(b[1])])
+	extensions, rest, ok := readVector(b[2+int(b[1]):])
+	if !ok || len(rest) != 0 {
+		return errIncomplete
+	}
+	for len(extensions) != 0 {
+		if len(extensions) < 2 {
+			return errIncomplete
+		}
+		extType := binary.BigEndian.Uint16(extensions)
+		var data []byte
+		if data, extensions, ok = readVector(extensions[2:]); !ok {
+			return errIncomplete
+		}
+		c.Extensions = append(c.Extensions, ECHExtension{Type: extType, Data: data})
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/newde36524/ew/utils"
+	"github.com/newde36524/ew/utils/log"
+)
+
+// ECHPolicy 服务端的 ECH 策略
+type ECHPolicy string
+
+const (
+	ECHRequired  ECHPolicy = "required"  // 必须使用 ECH，无法使用时拒绝连接（不会退回明文 SNI）
+	ECHPreferred ECHPolicy = "preferred" // 优先使用 ECH，ECH 不可用或服务器未启用时退回普通 TLS
+	ECHDisabled  ECHPolicy = "disabled"  // 不使用 ECH，直接使用普通 TLS
+)
+
+// ParseECHPolicy 解析 ECH 策略，空字符串为 required
+func ParseECHPolicy(s string) (ECHPolicy, error) {
+	switch policy := ECHPolicy(s); policy {
+	case "":
+		return ECHRequired, nil
+	case ECHRequired, ECHPreferred, ECHDisabled:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("未知的 ECH 策略: %s（可选 required、preferred、disabled）", s)
+	}
+}
+
+// useECH 该策略是否尝试 ECH
+func (p ECHPolicy) useECH() bool {
+	return p != ECHDisabled
+}
+
+// TLSConfig 按 ECH 策略返回连接服务端的 TLS 配置，serverName 为内层 SNI；
+// 返回的 ech 表示配置是否启用了 ECH
+//
+// preferred 策略在 ECH 配置不可用时退回普通 TLS（SNI 明文可见），required 策略返回错误
+func (c *ProxyClientConfig) TLSConfig(serverName string) (config *tls.Config, ech bool, err error) {
+	if c.ECHPolicy.useECH() {
+		config, err = c.Ech.GetTlsCfg(serverName)
+		if err == nil {
+			return config, true, nil
+		}
+		if c.ECHPolicy != ECHPreferred {
+			return nil, false, err
+		}
+		log.Printf("[ECH] 服务端 %s ECH 配置不可用，退回普通 TLS: %v", c.ServerAddr, err)
+	}
+	config, err = utils.BuildTLS13Config(serverName)
+	return config, false, err
+}
+
+// fallbackToPlain 握手失败后是否应退回普通 TLS：仅 preferred 策略，
+// 且服务器拒绝了 ECH 又未提供重试配置（服务器未启用 ECH）
+func (c *ProxyClientConfig) fallbackToPlain(err error) bool {
+	if c.ECHPolicy != ECHPreferred {
+		return false
+	}
+	retryConfigs, rejected := echRejection(err)
+	return rejected && len(retryConfigs) == 0
+}
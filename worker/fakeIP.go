@@ -0,0 +1,80 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/newde36524/ew/utils"
+)
+
+// FakeIPPool 为域名分配虚假 IPv4 地址，连接到达时再还原为域名，从而无需解析即可按域名分流
+type FakeIPPool struct {
+	mu     sync.Mutex
+	ipNet  *net.IPNet
+	base   uint32 // 第一个可分配地址
+	size   uint32 // 可分配地址数量
+	next   uint32 // 下一次分配的偏移（循环复用最早分配的地址）
+	byIP   map[uint32]string
+	byName map[string]uint32
+}
+
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 fake-ip 地址段: %w", err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if ipNet.IP.To4() == nil || bits != 32 || bits-ones < 3 {
+		return nil, errors.New("fake-ip 地址段必须是 /29 或更大的 IPv4 网段")
+	}
+	total := uint32(1) << (bits - ones)
+	return &FakeIPPool{
+		ipNet: ipNet,
+		// 跳过网络地址、网关（.1）和广播地址
+		base:   utils.IpToUint32(ipNet.IP) + 2,
+		size:   total - 3,
+		byIP:   make(map[uint32]string),
+		byName: make(map[string]uint32),
+	}, nil
+}
+
+// Alloc 返回域名对应的虚假地址，已分配过的域名返回同一地址
+func (f *FakeIPPool) Alloc(domain string) net.IP {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if offset, ok := f.byName[domain]; ok {
+		return f.ip(offset)
+	}
+	offset := f.next
+	f.next = (f.next + 1) % f.size
+	if old, ok := f.byIP[offset]; ok {
+		delete(f.byName, old)
+	}
+	f.byIP[offset] = domain
+	f.byName[domain] = offset
+	return f.ip(offset)
+}
+
+// Lookup 将虚假地址还原为域名
+func (f *FakeIPPool) Lookup(ip net.IP) (string, bool) {
+	if !f.Contains(ip) {
+		return "", false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	domain, ok := f.byIP[utils.IpToUint32(ip)-f.base]
+	return domain, ok
+}
+
+// Contains 判断地址是否属于 fake-ip 地址段
+func (f *FakeIPPool) Contains(ip net.IP) bool {
+	return ip.To4() != nil && f.ipNet.Contains(ip)
+}
+
+func (f *FakeIPPool) ip(offset uint32) net.IP {
+	v := f.base + offset
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,126 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// CoalesceConfig 上行写合并：客户端的小块写入在 Window 内合并为一个 WebSocket 消息
+type CoalesceConfig struct {
+	Window   time.Duration // 合并等待时间，0 为不合并
+	MaxFrame int           // 单个消息最大数据长度，0 使用默认缓冲区大小（32KB）
+}
+
+// coalesceMaxMisses 连续多少次等待没有合并到数据后暂停合并（交互式流量不再增加延迟），
+// 两次读取间隔小于 Window 时恢复
+const coalesceMaxMisses = 3
+
+// coalescer 单条隧道的写合并状态，只在 clientToServer 中使用
+type coalescer struct {
+	window   time.Duration
+	misses   int
+	lastRead time.Time
+}
+
+// newFramePool 按最大消息长度创建上行缓冲区池，不大于默认缓冲区时共用 bufferPool
+func newFramePool(maxFrame int) *sync.Pool {
+	if maxFrame <= 32*1024 {
+		return &bufferPool
+	}
+	return &sync.Pool{
+		New: func() any {
+			return make([]byte, maxFrame)
+		},
+	}
+}
+
+// coalesce 已读取 n 字节且数据较少时，在合并窗口内继续读取，返回合并后的长度；
+// 窗口内读到 EOF 或出错时一并返回，调用方先发送已读数据再处理错误
+//
+// 窗口通过读超时实现，结束后清除超时；隧道拆除时 relay 同样用读超时中断读取，
+// 清除后再检查 ctx，避免覆盖拆除时设置的超时
+func (p *ProxyClient) coalesce(ctx context.Context, buf []byte, n int) (int, error) {
+	c := &p.coalescer
+	now := time.Now()
+	if now.Sub(c.lastRead) < c.window {
+		c.misses = 0 // 连续写入，恢复合并
+	}
+	c.lastRead = now
+	if c.window <= 0 || n >= len(buf)/2 || c.misses >= coalesceMaxMisses {
+		return n, nil
+	}
+
+	p.Conn.SetReadDeadline(now.Add(c.window)) //nolint:errcheck
+	merged := n
+	var err error
+	for merged < len(buf) {
+		var m int
+		m, err = p.Conn.Read(buf[merged:])
+		merged += m
+		if err != nil {
+			break
+		}
+	}
+	p.Conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+	if ctx.Err() != nil {
+		return merged, ctx.Err()
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = nil
+	}
+	if merged > n {
+		c.misses = 0
+		p.touch()
+	} else {
+		c.misses++
+	}
+	return merged, err
+}
+
+// CompressionMode 上行 WebSocket 消息的 permessage-deflate 压缩策略
+type CompressionMode string
+
+const (
+	CompressionOff  CompressionMode = "off"  // 不协商压缩
+	CompressionAuto CompressionMode = "auto" // 协商压缩，只压缩明文目标（排除 TLS 首包与常见加密端口）
+	CompressionAll  CompressionMode = "all"  // 协商压缩，压缩所有目标
+)
+
+// encryptedPorts 常见的加密协议端口，数据不可压缩
+var encryptedPorts = map[string]bool{
+	"22": true, "443": true, "465": true, "563": true, "636": true, "853": true,
+	"989": true, "990": true, "993": true, "995": true, "5223": true, "8443": true,
+}
+
+// ParseCompressionMode 解析压缩策略，空字符串为 off
+func ParseCompressionMode(s string) (CompressionMode, error) {
+	switch mode := CompressionMode(s); mode {
+	case "":
+		return CompressionOff, nil
+	case CompressionOff, CompressionAuto, CompressionAll:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("未知的压缩策略: %s（可选 off、auto、all）", s)
+	}
+}
+
+// compressFor 按目标与首包决定该隧道的上行消息是否压缩
+func (m CompressionMode) compressFor(target string, payload []byte) bool {
+	switch m {
+	case CompressionAll:
+		return true
+	case CompressionAuto:
+		if _, port, err := net.SplitHostPort(target); err == nil && encryptedPorts[port] {
+			return false
+		}
+		// TLS 记录（握手 0x16，版本 0x03xx）
+		return len(payload) < 2 || payload[0] != 0x16 || payload[1] != 0x03
+	default:
+		return false
+	}
+}
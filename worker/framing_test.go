@@ -0,0 +1,238 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/newde36524/ew/utils"
+)
+
+// wsSink 统计收到的消息数与数据量的 WebSocket 服务端；客户端写入的线路字节数（压缩后）由 wire 统计
+type wsSink struct {
+	server   *httptest.Server
+	messages atomic.Int64
+	bytes    atomic.Int64
+	wire     atomic.Int64
+	notify   chan struct{} // 每收到一个消息通知一次（不阻塞）
+}
+
+func newWSSink(b *testing.B) *wsSink {
+	b.Helper()
+	s := &wsSink{notify: make(chan struct{}, 1)}
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			s.messages.Add(1)
+			s.bytes.Add(int64(len(msg)))
+			select {
+			case s.notify <- struct{}{}:
+			default:
+			}
+		}
+	}))
+	b.Cleanup(s.server.Close)
+	return s
+}
+
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (s *wsSink) dial(b *testing.B) *utils.WebSocketWrap {
+	b.Helper()
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, written: &s.wire}, nil
+		},
+	}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(s.server.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return utils.NewWebSocketWrap(conn, utils.TunnelV1)
+}
+
+// waitBytes 等待服务端累计收到 n 字节数据
+func (s *wsSink) waitBytes(b *testing.B, n int64) {
+	deadline := time.After(10 * time.Second)
+	for s.bytes.Load() < n {
+		select {
+		case <-s.notify:
+		case <-deadline:
+			b.Fatalf("服务端只收到 %d 字节，应为 %d", s.bytes.Load(), n)
+		}
+	}
+}
+
+// startUpstream 启动 clientToServer，返回写入客户端数据的连接
+func startUpstream(b *testing.B, sink *wsSink, window time.Duration) net.Conn {
+	b.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close() //nolint:errcheck
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ws := sink.dial(b)
+	p := &ProxyClient{Conn: conn, wsConn: ws, coalescer: coalescer{window: window}, framePool: newFramePool(64 * 1024)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.clientToServer(ctx) //nolint:errcheck
+	}()
+	b.Cleanup(func() {
+		cancel()
+		client.Close() //nolint:errcheck
+		<-done
+		ws.Close()   //nolint:errcheck
+		conn.Close() //nolint:errcheck
+	})
+	return client
+}
+
+var coalesceWindows = []time.Duration{0, 100 * time.Microsecond, 500 * time.Microsecond, 2 * time.Millisecond}
+
+// BenchmarkCoalesce 不同合并窗口下三种上行流量的表现，msgs/op 为每次操作产生的 WebSocket 消息数
+//
+// bulk 为连续大块写入，窗口不应增加消息数或降低吞吐。
+// burst 为连续 64 次 64 字节的小写入（如逐帧写出的 HTTP/2、RPC），不合并时每次读取都成为一个消息，
+// 窗口内合并为少量消息，代价是每个突发的最后一次写入多等待一个窗口；
+// 单个 CPU 时写入方在读取方运行前已写完，观察不到拆分，需使用 -cpu 2 或更多。
+// interactive 为间隔 1ms 的单次小写入（如 SSH 按键），latency-µs 为写入到服务端收到的延迟：
+// 写入间隔大于窗口时连续 coalesceMaxMisses 次未合并后暂停合并，延迟接近不合并时；
+// 窗口不小于写入间隔时一直合并，每次写入都增加一个窗口的延迟
+//
+//	go test -run '^$' -bench Coalesce -cpu 2 ./worker
+func BenchmarkCoalesce(b *testing.B) {
+	for _, window := range coalesceWindows {
+		b.Run(fmt.Sprintf("bulk/window=%v", window), func(b *testing.B) {
+			sink := newWSSink(b)
+			client := startUpstream(b, sink, window)
+			chunk := make([]byte, 32*1024)
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			sink.waitBytes(b, int64(b.N*len(chunk)))
+			b.ReportMetric(float64(sink.messages.Load())/float64(b.N), "msgs/op")
+		})
+	}
+
+	for _, window := range coalesceWindows {
+		b.Run(fmt.Sprintf("burst/window=%v", window), func(b *testing.B) {
+			sink := newWSSink(b)
+			client := startUpstream(b, sink, window)
+			small := make([]byte, 64)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 64; j++ {
+					if _, err := client.Write(small); err != nil {
+						b.Fatal(err)
+					}
+				}
+				sink.waitBytes(b, int64((i+1)*64*len(small)))
+			}
+			b.ReportMetric(float64(sink.messages.Load())/float64(b.N), "msgs/op")
+		})
+	}
+
+	for _, window := range coalesceWindows {
+		b.Run(fmt.Sprintf("interactive/window=%v", window), func(b *testing.B) {
+			sink := newWSSink(b)
+			client := startUpstream(b, sink, window)
+			key := []byte("x")
+			var total time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if _, err := client.Write(key); err != nil {
+					b.Fatal(err)
+				}
+				sink.waitBytes(b, int64(i+1))
+				total += time.Since(start)
+				time.Sleep(time.Millisecond)
+			}
+			b.ReportMetric(float64(total.Microseconds())/float64(b.N), "latency-µs")
+			b.ReportMetric(float64(sink.messages.Load())/float64(b.N), "msgs/op")
+		})
+	}
+}
+
+// BenchmarkCompression 上行消息压缩对不同数据的效果（ratio 为压缩后线路字节数 / 数据字节数）：
+// 明文（HTML、JSON）压缩率高；TLS 记录（已加密）几乎无法压缩，压缩只消耗 CPU，
+// 因此 CompressionAuto 按 TLS 首包与加密端口跳过
+//
+//	go test -run '^$' -bench Compression ./worker
+func BenchmarkCompression(b *testing.B) {
+	html := bytes.Repeat([]byte(`<div class="item"><a href="/page/1">Example link text</a><span>description</span></div>`+"\n"), 180)
+	json := bytes.Repeat([]byte(`{"id":12345,"name":"example","tags":["a","b","c"],"active":true,"score":0.75},`), 200)
+	tlsRecord := make([]byte, 16*1024)
+	rand.Read(tlsRecord) //nolint:errcheck
+	copy(tlsRecord, []byte{0x17, 0x03, 0x03, 0x40, 0x00})
+
+	for _, payload := range []struct {
+		name string
+		data []byte
+	}{{"html", html}, {"json", json}, {"tls", tlsRecord}} {
+		for _, compress := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/compress=%v", payload.name, compress), func(b *testing.B) {
+				sink := newWSSink(b)
+				ws := sink.dial(b)
+				defer ws.Close() //nolint:errcheck
+				ws.SetCompression(compress)
+				wireStart := sink.wire.Load()
+				b.SetBytes(int64(len(payload.data)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := ws.WriteData(payload.data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				sink.waitBytes(b, int64(b.N*len(payload.data)))
+				b.ReportMetric(float64(sink.wire.Load()-wireStart)/float64(b.N*len(payload.data)), "ratio")
+			})
+		}
+	}
+}
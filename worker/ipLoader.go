@@ -34,14 +34,23 @@ type IPLoader struct {
 
 	// 中国IP列表（IPv6）
 	chinaIPV6Ranges utils.Store[[]ipRangeV6]
-	routingMode     string
-	ipv4DataSync    utils.DataSync
-	ipv6DataSync    utils.DataSync
+
+	// 中国域名列表（按后缀匹配）
+	chinaDomains utils.Store[map[string]struct{}]
+
+	routingMode    string
+	ipv4DataSync   utils.DataSync
+	ipv6DataSync   utils.DataSync
+	domainDataSync utils.DataSync
+
+	// lookupIP 用于按 IP 判断域名的解析函数，为 nil 时仅按域名列表决策，不解析
+	lookupIP func(domain string) ([]net.IP, error)
 }
 
 func NewIPLoader(routingMode string) *IPLoader {
 	return &IPLoader{
 		routingMode: routingMode,
+		lookupIP:    net.LookupIP,
 		ipv4DataSync: utils.NewFileSync("IPV4", "chn_ip.txt", func() ([]byte, error) {
 			url := "https://gh-proxy.com/https://raw.githubusercontent.com/mayaxcn/china-ip-list/refs/heads/master/chn_ip.txt"
 			log.Printf("[下载] 正在下载 IP 列表")
@@ -71,9 +80,28 @@ func NewIPLoader(routingMode string) *IPLoader {
 			}
 			return content, nil
 		}),
+		domainDataSync: utils.NewFileSync("域名", "chn_domain.txt", func() ([]byte, error) {
+			url := "https://gh-proxy.com/https://raw.githubusercontent.com/felixonmars/dnsmasq-china-list/master/accelerated-domains.china.conf"
+			log.Printf("[下载] 正在下载域名列表")
+			resp, err := utils.GetDataByUrl(url, nil)
+			if err != nil {
+				return nil, fmt.Errorf("自动下载域名列表失败: %w", err)
+			}
+			defer resp.Body.Close()
+			content, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return nil, fmt.Errorf("读取下载内容失败: %w", err)
+			}
+			return content, nil
+		}),
 	}
 }
 
+// SetResolver 设置域名分流时使用的解析函数（nil 表示不解析，仅按域名列表判断）
+func (i *IPLoader) SetResolver(lookupIP func(domain string) ([]net.IP, error)) {
+	i.lookupIP = lookupIP
+}
+
 func (i *IPLoader) LoadWithRoutingMode() {
 	// 加载中国IP列表（如果需要）
 	switch i.routingMode {
@@ -98,6 +126,12 @@ func (i *IPLoader) LoadWithRoutingMode() {
 		} else {
 			log.Printf("[警告] 未加载到任何中国IP列表，将使用默认规则")
 		}
+
+		if err := i.LoadChinaDomainList(); err != nil {
+			log.Printf("[警告] 加载中国域名列表失败: %v", err)
+		} else {
+			log.Printf("[启动] 已加载 %d 个中国域名", len(i.chinaDomains.Get()))
+		}
 	case Global:
 		log.Printf("[启动] 分流模式: 全局代理")
 	case None:
@@ -293,6 +327,62 @@ func (i *IPLoader) LoadChinaIPV6List() error {
 	return err
 }
 
+// LoadChinaDomainList 从程序目录加载中国域名列表（兼容 dnsmasq server=/domain/ip 格式）
+func (i *IPLoader) LoadChinaDomainList() error {
+	_, err := i.chinaDomains.GetOrStore(func() (map[string]struct{}, error) {
+		data, err := i.domainDataSync.Sync()
+		if err != nil {
+			return nil, err
+		}
+		domains := make(map[string]struct{})
+		scanner := bufio.NewScanner(bytes.NewBuffer(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if strings.HasPrefix(line, "server=/") {
+				parts := strings.Split(line, "/")
+				if len(parts) < 3 {
+					continue
+				}
+				line = parts[1]
+			}
+			domains[strings.ToLower(strings.Trim(line, "."))] = struct{}{}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("读取域名列表文件失败: %w", err)
+		}
+
+		if len(domains) == 0 {
+			return nil, errors.New("域名列表为空")
+		}
+		return domains, nil
+	})
+
+	return err
+}
+
+// IsChinaDomain 检查域名（及其任一上级域名）是否在中国域名列表中
+func (i *IPLoader) IsChinaDomain(domain string) bool {
+	domains := i.chinaDomains.Get()
+	if len(domains) == 0 {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for {
+		if _, ok := domains[domain]; ok {
+			return true
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+}
+
 // ShouldBypassProxy 根据分流模式判断是否应该绕过代理（直连）
 func (i *IPLoader) ShouldBypassProxy(targetHost string) bool {
 	if i.routingMode == None {
@@ -309,8 +399,15 @@ func (i *IPLoader) ShouldBypassProxy(targetHost string) bool {
 		if ip := net.ParseIP(targetHost); ip != nil {
 			return i.IsChinaIP(targetHost)
 		}
+		// 命中中国域名列表直接直连，无需解析
+		if i.IsChinaDomain(targetHost) {
+			return true
+		}
+		if i.lookupIP == nil {
+			return false
+		}
 		// 如果是域名，先解析IP
-		ips, err := net.LookupIP(targetHost)
+		ips, err := i.lookupIP(targetHost)
 		if err != nil {
 			// 解析失败，默认走代理
 			return false
@@ -4,13 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -36,20 +39,36 @@ type ProxyClient struct {
 	Conn         net.Conn
 	wsConn       *utils.WebSocketWrap
 	clientAddr   string
-	clientConfig *ProxyClientConfig
+	auth         UserAuth             // SOCKS5 / HTTP 认证用户，nil 为不认证
+	user         string               // 认证通过的用户名
+	servers      []*ProxyClientConfig // 按顺序尝试的服务端
 	IPLoader     *IPLoader
-	Ech          *Ech
-	done         chan struct{}
+	resolver     *Resolver
+	earlyData    bool // SOCKS5 隧道携带客户端首包（0-RTT）
+	timeouts     TimeoutConfig
+	bandwidth    *bandwidthLimiter
+	throttle     utils.Throttle // 当前连接的上下行限速
+	connLimit    *connLimiter
+	quotaAction  QuotaAction
+	quotaWarning *quotaDirectWarning
+	stats        *TrafficStats
+	upstream     string     // 隧道使用的服务端
+	earlyBytes   int64      // 随 CONNECT 发送的客户端首包字节数
+	traffic      *connStats // 当前隧道的实时统计
+	coalescer    coalescer
+	framePool    *sync.Pool // 上行缓冲区，大小为最大消息长度
+	compression  CompressionMode
+
+	handshakeDeadline time.Time    // 握手超时时间，握手完成后清零
+	lastActive        atomic.Int64 // 隧道最后一次收发数据的时间（UnixNano）
 }
 
-func NewProxyClient(conn net.Conn, clientAddr string, config *ProxyClientConfig, ipLoader *IPLoader, ech *Ech) *ProxyClient {
+func NewProxyClient(conn net.Conn, clientAddr string, servers []*ProxyClientConfig, ipLoader *IPLoader) *ProxyClient {
 	return &ProxyClient{
-		Conn:         conn,
-		clientConfig: config,
-		IPLoader:     ipLoader,
-		Ech:          ech,
-		clientAddr:   clientAddr,
-		done:         make(chan struct{}),
+		Conn:       conn,
+		servers:    servers,
+		IPLoader:   ipLoader,
+		clientAddr: clientAddr,
 	}
 }
 
@@ -57,21 +76,13 @@ func (p *ProxyClient) ClientAddr() string {
 	return p.clientAddr
 }
 
-func (p *ProxyClient) wait() {
-	p.done <- struct{}{}
-	close(p.done)
-	p.wsConn.Close() //nolint:errcheck
-}
-
 func (p *ProxyClient) ReadFirstByte() byte {
-	p.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	// 读取第一个字节判断协议
+	// 读取第一个字节判断协议（超时由握手超时控制）
 	buf := make([]byte, 1)
 	n, err := p.Conn.Read(buf)
 	if err != nil || n == 0 {
 		return 0
 	}
-	p.Conn.SetDeadline(time.Time{})
 	return buf[0]
 }
 
@@ -89,6 +100,9 @@ func (p *ProxyClient) handleHTTP(firstByte byte) {
 		p.Conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n")) //nolint:errcheck
 		return
 	}
+	if !p.httpAuth(req) {
+		return
+	}
 	for key := range req.Header {
 		if headerBlacklist[strings.ToLower(key)] {
 			req.Header.Del(key)
@@ -139,16 +153,48 @@ func (p *ProxyClient) handleHTTP(firstByte byte) {
 }
 
 func (p *ProxyClient) handleTunnel(target string, mode int, firstFrame string) error {
+	p.finishHandshake()
+
 	// 解析目标地址
-	targetHost, _, err := net.SplitHostPort(target)
+	targetHost, targetPort, err := net.SplitHostPort(target)
 	if err != nil {
 		targetHost = target
 	}
 
+	// 通过 fake-ip / redir-host 记录还原域名，便于按域名分流并由远端解析；
+	// redir-host 记录只用于透明代理与 TUN（只能拿到 IP），SOCKS5 / HTTP 客户端指定的真实 IP 按原样连接
+	if ip := net.ParseIP(targetHost); ip != nil && p.resolver != nil {
+		if domain, ok := p.resolver.LookupHost(ip, mode == utils.ModeTransparent); ok {
+			targetHost = domain
+			target = net.JoinHostPort(domain, targetPort)
+		} else if p.resolver.IsFakeIP() && p.resolver.fakeIP.Contains(ip) {
+			utils.SendErrorResponse(p.Conn, mode)
+			return fmt.Errorf("未知的 fake-ip 地址: %s", ip)
+		}
+	}
+
 	// 检查是否应该绕过代理（直连）
-	if p.IPLoader.ShouldBypassProxy(targetHost) {
+	direct := p.IPLoader.ShouldBypassProxy(targetHost)
+	if !direct && p.quotaAction == QuotaDirect && p.quotaExhausted() {
+		p.quotaWarning.warn()
+		direct = true
+	}
+	if !direct {
+		releaseTunnel, err := p.connLimit.acquire(p.clientAddr)
+		if err != nil {
+			utils.SendRejectResponse(p.Conn, mode)
+			return err
+		}
+		defer releaseTunnel()
+	}
+	throttle, release := p.bandwidth.throttle(p.clientAddr, p.user, direct)
+	defer release()
+	p.throttle = throttle
+	if direct {
 		log.Printf("[分流] %s -> %s (直连，绕过代理)", p.clientAddr, target)
-		return utils.HandleDirectConnection(p.Conn, target, p.clientAddr, mode, firstFrame)
+		traffic := newConnStats(p.stats, p.statsKey(targetHost, StatsDirect))
+		defer traffic.flush()
+		return utils.HandleDirectConnection(p.Conn, target, p.clientAddr, mode, firstFrame, throttle, traffic.add)
 	}
 
 	// 走代理
@@ -158,79 +204,189 @@ func (p *ProxyClient) handleTunnel(target string, mode int, firstFrame string) e
 		return err
 	}
 
+	p.traffic = newConnStats(p.stats, p.statsKey(targetHost, p.upstream))
+	p.traffic.add(int64(len(firstFrame))+p.earlyBytes, 0)
+	defer p.traffic.flush()
+
 	log.Printf("[代理] %s 已连接: %s", p.clientAddr, target)
+	if reason := p.relay(context.Background()); reason != nil {
+		log.Printf("[代理] %s 已断开: %s (%v)", p.clientAddr, target, reason)
+	} else {
+		log.Printf("[代理] %s 已断开: %s (正常关闭)", p.clientAddr, target)
+	}
+	return nil
+}
 
-	// 双向转发
-	// Client -> Server
-	go p.clientToServer()
+// statsKey 当前连接在流量统计中的维度
+func (p *ProxyClient) statsKey(domain, server string) StatsKey {
+	return StatsKey{Client: clientIP(p.clientAddr), User: p.user, Domain: domain, Server: server}
+}
 
+// clientIP 客户端地址中的 IP，用于按客户端限制与统计
+func clientIP(clientAddr string) string {
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		return host
+	}
+	return clientAddr
+}
+
+// relay 双向转发，返回时两个转发协程都已退出、WebSocket（及其保活协程）已关闭；
+// 返回隧道的关闭原因，两个方向都正常结束时返回 nil
+//
+// 一个方向结束（EOF / FIN）时只半关闭对应的写端；两个方向都结束、任一方向出错、空闲超时、
+// 超过最长连接时间或 ctx 取消时拆除隧道：关闭 WebSocket 并中断客户端读取，使仍在阻塞的方向返回。
+// 客户端连接由调用方关闭
+func (p *ProxyClient) relay(ctx context.Context) error {
+	if p.timeouts.MaxLifetime > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, p.timeouts.MaxLifetime, errMaxLifetime)
+		defer cancelTimeout()
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	torndown := make(chan struct{})
+	context.AfterFunc(ctx, func() {
+		p.wsConn.Close()                   //nolint:errcheck
+		p.Conn.SetReadDeadline(time.Now()) //nolint:errcheck
+		close(torndown)
+	})
+	if p.timeouts.Idle > 0 {
+		idleTimer := p.watchIdle(func() { cancel(errIdleTimeout) })
+		defer idleTimer.Stop()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// Client -> Server
+	go func() {
+		defer wg.Done()
+		if err := p.clientToServer(ctx); err != nil {
+			cancel(err)
+		}
+	}()
 	// Server -> Client
-	go p.serverToClient()
+	go func() {
+		defer wg.Done()
+		if err := p.serverToClient(ctx); err != nil {
+			cancel(err)
+		}
+	}()
 
-	p.wait()
-	log.Printf("[代理] %s 已断开: %s", p.clientAddr, target)
-	return nil
+	wg.Wait()
+	reason := context.Cause(ctx)
+	cancel(nil)
+	<-torndown
+	return reason
 }
 
 func (p *ProxyClient) connenct(target string, mode int, firstFrame string) error {
-	wsConn, err := p.dialWebSocketWithECH(2)
+	if mode == utils.ModeSOCKS5 && p.earlyData {
+		return p.connectWithEarlyData(target)
+	}
+	wsConn, err := p.openTunnel(target, []byte(firstFrame), mode)
 	if err != nil {
 		utils.SendErrorResponse(p.Conn, mode)
 		return err
 	}
-	go wsConn.KeepAlive() // 保活
-	p.wsConn = wsConn
 
-	if err := wsConn.Connenct(p.Conn, target, firstFrame, mode); err != nil {
+	// 发送成功响应（根据模式不同而不同）
+	if err := utils.SendSuccessResponse(p.Conn, mode); err != nil {
+		wsConn.Close() //nolint:errcheck
 		return err
 	}
+	go wsConn.KeepAlive() // 保活，随 WebSocket 关闭退出
+	p.wsConn = wsConn
 	return nil
 }
 
-func (p *ProxyClient) clientToServer() error {
-	defer func() {
-		select {
-		case <-p.done:
-		default:
-		}
-	}()
+// connectWithEarlyData 先回复 SOCKS5 成功，短暂等待客户端首包（如 TLS ClientHello）并随 CONNECT 一起发送，
+// 省去等待 CONNECTED 的一次往返
+//
+// 成功响应已经发出，远端连接失败时无法再回复错误，只能关闭客户端连接
+func (p *ProxyClient) connectWithEarlyData(target string) error {
+	if err := utils.SendSuccessResponse(p.Conn, utils.ModeSOCKS5); err != nil {
+		return err
+	}
+
 	buf := bufferPool.Get().([]byte)
 	defer bufferPool.Put(buf)
+	p.Conn.SetReadDeadline(time.Now().Add(earlyDataTimeout)) //nolint:errcheck
+	n, err := p.Conn.Read(buf[:earlyDataSize])
+	p.Conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+	if err != nil {
+		// 超时说明是服务端先发言的协议（如 SMTP），不带首包连接
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return err
+		}
+	}
+
+	wsConn, err := p.openTunnel(target, buf[:n], utils.ModeSOCKS5)
+	if err != nil {
+		return err
+	}
+	p.earlyBytes = int64(n)
+	go wsConn.KeepAlive() // 保活
+	p.wsConn = wsConn
+	return nil
+}
+
+// clientToServer 转发客户端数据，客户端关闭写端（EOF）时发送 FIN 并返回 nil
+//
+// 小块写入按 coalescer 合并为一个消息
+func (p *ProxyClient) clientToServer(ctx context.Context) error {
+	pool := p.framePool
+	if pool == nil {
+		pool = &bufferPool
+	}
+	buf := pool.Get().([]byte)
+	defer pool.Put(buf)
 	for {
 		n, err := p.Conn.Read(buf)
-		if err != nil {
-			p.wsConn.WriteMessage(websocket.TextMessage, []byte("CLOSE")) //nolint:errcheck
-			return err
+		p.touch()
+		if n > 0 && err == nil {
+			n, err = p.coalesce(ctx, buf, n)
 		}
 
-		err = p.wsConn.WriteMessage(websocket.BinaryMessage, buf[:n])
+		if n > 0 {
+			if err := p.throttle.Up.Wait(ctx, n); err != nil {
+				return err
+			}
+			if err := p.wsConn.WriteData(buf[:n]); err != nil {
+				return err
+			}
+			p.traffic.add(int64(n), 0)
+		}
+		if err == io.EOF {
+			return p.wsConn.WriteFin()
+		}
 		if err != nil {
-			return err
+			p.wsConn.WriteClose() //nolint:errcheck
+			return fmt.Errorf("%w: %w", errClientClosed, err)
 		}
 	}
 }
 
-func (p *ProxyClient) serverToClient() error {
-	defer func() {
-		select {
-		case <-p.done:
-		default:
-		}
-	}()
+// serverToClient 转发远端数据，远端关闭写端（FIN）时半关闭客户端连接并返回 nil
+func (p *ProxyClient) serverToClient(ctx context.Context) error {
 	for {
-		mt, msg, err := p.wsConn.ReadMessage()
+		msg, err := p.wsConn.ReadData()
+		p.touch()
+		if err == io.EOF {
+			return utils.CloseWrite(p.Conn)
+		}
+		if errors.Is(err, utils.ErrTunnelClosed) {
+			return errServerClosed
+		}
 		if err != nil {
 			return err
 		}
-
-		if mt == websocket.TextMessage {
-			if len(msg) == 5 && string(msg) == "CLOSE" {
-				return err
-			}
+		if err := p.throttle.Down.Wait(ctx, len(msg)); err != nil {
+			return err
 		}
 		if _, err := p.Conn.Write(msg); err != nil {
-			return err
+			return fmt.Errorf("%w: %w", errClientClosed, err)
 		}
+		p.traffic.add(0, int64(len(msg)))
 	}
 }
 
@@ -249,8 +405,7 @@ func (p *ProxyClient) handleSOCKS5() {
 		return
 	}
 
-	// 响应无需认证
-	if _, err := p.Conn.Write([]byte{0x05, 0x00}); err != nil {
+	if !p.socks5Auth(methods) {
 		return
 	}
 
@@ -333,6 +488,8 @@ func (p *ProxyClient) handleSOCKS5() {
 }
 
 func (p *ProxyClient) handleUDPAssociate(tcpConn io.ReadWriter, clientAddr string) {
+	p.finishHandshake()
+
 	// 创建 UDP 监听器
 	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
 	if err != nil {
@@ -466,10 +623,16 @@ func (p *ProxyClient) handleUDPRelay(udpConn *net.UDPConn, clientAddr string, st
 }
 
 func (p *ProxyClient) handleDNSQuery(udpConn *net.UDPConn, clientAddr *net.UDPAddr, dnsQuery []byte, socks5Header []byte) {
-	// 通过 DoH 查询（使用重命名后的函数）
-	dnsResponse, err := p.queryDoHForProxy(dnsQuery)
+	// 使用内置 DNS（与透明代理/TUN 共用缓存、分流与 fake-ip 记录）
+	if p.resolver == nil {
+		log.Printf("[UDP-DNS] DNS 解析器未初始化")
+		return
+	}
+	dnsResponse, err := p.resolver.Respond(dnsQuery)
 	if err != nil {
 		log.Printf("[UDP-DNS] DoH 查询失败: %v", err)
+	}
+	if dnsResponse == nil {
 		return
 	}
 
@@ -479,133 +642,178 @@ func (p *ProxyClient) handleDNSQuery(udpConn *net.UDPConn, clientAddr *net.UDPAd
 	response = append(response, dnsResponse...)
 
 	// 发送响应
-	_, err = udpConn.WriteToUDP(response, clientAddr)
-	if err != nil {
+	if _, err := udpConn.WriteToUDP(response, clientAddr); err != nil {
 		log.Printf("[UDP-DNS] 发送响应失败: %v", err)
 		return
 	}
 
-	log.Printf("[UDP-DNS] DoH 查询成功，响应 %d 字节", len(dnsResponse))
+	if err == nil {
+		log.Printf("[UDP-DNS] DoH 查询成功，响应 %d 字节", len(dnsResponse))
+	}
+}
+
+// openTunnel 依次尝试各服务端，返回第一个成功发送连接请求的隧道
+//
+// 服务端拒绝连接（目标不可达等）时直接返回，不再尝试其它服务端
+func (p *ProxyClient) openTunnel(target string, firstFrame []byte, mode int) (*utils.WebSocketWrap, error) {
+	lastErr := errors.New("未配置服务端")
+	compress := p.compression.compressFor(target, firstFrame)
+	for _, server := range p.serversByQuota() {
+		wsConn, err := openServerTunnel(server, target, firstFrame, mode, compress)
+		if err == nil || errors.Is(err, utils.ErrConnectRejected) {
+			p.upstream = server.ServerAddr
+			return wsConn, err
+		}
+		if len(p.servers) > 1 {
+			log.Printf("[代理] 服务端 %s 连接失败: %v", server.ServerAddr, err)
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// serversByQuota 按顺序返回服务端，今日连接数接近配额的排在最后
+func (p *ProxyClient) serversByQuota() []*ProxyClientConfig {
+	servers := make([]*ProxyClientConfig, 0, len(p.servers))
+	var exhausted []*ProxyClientConfig
+	for _, server := range p.servers {
+		if server.quota.exhausted() {
+			exhausted = append(exhausted, server)
+			continue
+		}
+		servers = append(servers, server)
+	}
+	return append(servers, exhausted...)
+}
+
+// quotaExhausted 是否所有服务端今日连接数都接近配额
+func (p *ProxyClient) quotaExhausted() bool {
+	for _, server := range p.servers {
+		if !server.quota.exhausted() {
+			return false
+		}
+	}
+	return len(p.servers) != 0
+}
+
+// openServerTunnel 优先使用连接池中已握手的连接发送连接请求（只需一次往返），
+// 池中连接已失效时改用新连接
+//
+// compress 为该隧道的上行消息（含连接请求中的首包）是否压缩，仅在握手协商了 permessage-deflate 时生效
+func openServerTunnel(server *ProxyClientConfig, target string, firstFrame []byte, mode int, compress bool) (*utils.WebSocketWrap, error) {
+	if wsConn := server.pool.Get(); wsConn != nil {
+		wsConn.SetCompression(compress)
+		err := wsConn.SendConnect(target, firstFrame, mode)
+		if err == nil {
+			return wsConn, nil
+		}
+		wsConn.Close() //nolint:errcheck
+		if errors.Is(err, utils.ErrConnectRejected) {
+			return nil, err
+		}
+		log.Printf("[连接池] 服务端 %s 的空闲连接已失效，改用新连接: %v", server.ServerAddr, err)
+	}
+
+	wsConn, err := dialServer(server, 2)
+	if err != nil {
+		return nil, err
+	}
+	wsConn.SetCompression(compress)
+	if err := wsConn.SendConnect(target, firstFrame, mode); err != nil {
+		wsConn.Close() //nolint:errcheck
+		return nil, err
+	}
+	return wsConn, nil
 }
 
-func (p *ProxyClient) dialWebSocketWithECH(maxRetries int) (*utils.WebSocketWrap, error) {
-	host, port, path, err := utils.ParseServerAddr(p.clientConfig.ServerAddr)
+// dialServer 与服务端完成 TLS（ECH）与 WebSocket 握手
+func dialServer(server *ProxyClientConfig, maxRetries int) (*utils.WebSocketWrap, error) {
+	host, port, path, err := utils.ParseServerAddr(server.ServerAddr)
 	if err != nil {
 		return nil, err
 	}
 
 	wsURL := fmt.Sprintf("wss://%s:%s%s", host, port, path)
+	// 声明支持的最高隧道协议版本，旧版服务端忽略该请求头，使用 v1
+	header := http.Header{utils.TunnelVersionHeader: []string{strconv.Itoa(utils.TunnelV2)}}
+	if server.SNI != host {
+		// 通过前置域名连接时，Host 与内层 SNI 保持一致
+		header.Set("Host", server.SNI)
+	}
 
+	retried := false // 每次拨号最多使用一次服务器提供的重试配置
+	plain := false   // preferred 策略下服务器未启用 ECH，本次拨号改用普通 TLS
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		echBytes, echErr := p.Ech.GetECHList()
-		if echErr != nil {
-			if attempt < maxRetries {
-				p.Ech.RefreshECH() //nolint:errcheck
-				continue
-			}
-			return nil, echErr
+		// 每次拨号都取当前的 ECH 快照，刷新后立即生效
+		var tlsCfg *tls.Config
+		var useECH bool
+		var tlsErr error
+		if plain {
+			tlsCfg, tlsErr = utils.BuildTLS13Config(server.SNI)
+		} else {
+			tlsCfg, useECH, tlsErr = server.TLSConfig(server.SNI)
 		}
-
-		tlsCfg, tlsErr := p.Ech.BuildTLSConfigWithECH(p.clientConfig.ServerAddr, echBytes)
 		if tlsErr != nil {
+			if attempt < maxRetries && server.ECHPolicy.useECH() {
+				server.Ech.RefreshECH() //nolint:errcheck
+				continue
+			}
 			return nil, tlsErr
 		}
 
 		dialer := websocket.Dialer{
 			TLSClientConfig: tlsCfg,
 			Subprotocols: func() []string {
-				if len(p.clientConfig.Token) == 0 {
+				if len(server.Token) == 0 {
 					return nil
 				}
-				return []string{p.clientConfig.Token}
+				return []string{server.Token}
 			}(),
-			HandshakeTimeout: 10 * time.Second,
+			HandshakeTimeout:  10 * time.Second,
+			EnableCompression: server.compress,
 		}
 
-		if len(p.clientConfig.ServerIP) != 0 {
+		netDialer := utils.NewDialer(10 * time.Second)
+		dialer.NetDial = netDialer.Dial
+		if len(server.ServerIP) != 0 {
 			dialer.NetDial = func(network, address string) (net.Conn, error) {
 				_, port, err := net.SplitHostPort(address)
 				if err != nil {
 					return nil, err
 				}
-				return net.DialTimeout(network, net.JoinHostPort(p.clientConfig.ServerIP, port), 10*time.Second)
+				return netDialer.Dial(network, net.JoinHostPort(server.ServerIP, port))
 			}
 		}
 
-		wsConn, _, dialErr := dialer.Dial(wsURL, nil)
+		wsConn, resp, dialErr := dialer.Dial(wsURL, header)
+		if dialErr == nil || resp != nil {
+			// 请求已到达 Worker，计入每日配额
+			server.quota.add()
+		}
 		if dialErr != nil {
-			if strings.Contains(dialErr.Error(), "ECH") && attempt < maxRetries {
+			// 服务器拒绝 ECH 并提供了重试配置：立即使用新配置重连，不计入重试次数
+			if useECH && !retried && server.Ech.HandleRejection(dialErr) {
+				retried = true
+				attempt--
+				continue
+			}
+			if useECH && server.fallbackToPlain(dialErr) {
+				log.Printf("[ECH] 服务端 %s 未启用 ECH，退回普通 TLS", server.ServerAddr)
+				plain = true
+				attempt--
+				continue
+			}
+			if useECH && strings.Contains(dialErr.Error(), "ECH") && attempt < maxRetries {
 				log.Printf("[ECH] 连接失败，尝试刷新配置 (%d/%d)", attempt, maxRetries)
-				p.Ech.RefreshECH() //nolint:errcheck
+				server.Ech.RefreshECH() //nolint:errcheck
 				time.Sleep(time.Second)
 				continue
 			}
 			return nil, dialErr
 		}
 
-		return utils.NewWebSocketWrap(wsConn), nil
+		return utils.NewWebSocketWrap(wsConn, utils.NegotiatedTunnelVersion(resp)), nil
 	}
 
 	return nil, errors.New("连接失败，已达最大重试次数")
 }
-
-// queryDoHForProxy 通过 ECH 转发 DNS 查询到 Cloudflare DoH
-func (p *ProxyClient) queryDoHForProxy(dnsQuery []byte) ([]byte, error) {
-	_, port, _, err := utils.ParseServerAddr(p.clientConfig.ServerAddr)
-	if err != nil {
-		return nil, err
-	}
-
-	// 构建 DoH URL
-	dohURL := fmt.Sprintf("https://cloudflare-dns.com:%s/dns-query", port)
-
-	tlsCfg, err := p.Ech.GetTlsCfg()
-	if err != nil {
-		return nil, fmt.Errorf("构建 TLS 配置失败: %w", err)
-	}
-	// 创建 HTTP 客户端
-	transport := &http.Transport{
-		TLSClientConfig: tlsCfg,
-		Proxy:           nil, // 显式设置为 nil 表示不使用任何代理
-	}
-
-	// 如果指定了 IP，使用自定义 Dialer
-	if len(p.clientConfig.ServerIP) != 0 {
-		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			_, port, err := net.SplitHostPort(addr)
-			if err != nil {
-				return nil, err
-			}
-			dialer := &net.Dialer{
-				Timeout: 10 * time.Second,
-			}
-			return dialer.DialContext(ctx, network, net.JoinHostPort(p.clientConfig.ServerIP, port))
-		}
-	}
-
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   10 * time.Second,
-	}
-
-	// 发送 DoH 请求
-	req, err := http.NewRequest("POST", dohURL, bytes.NewReader(dnsQuery))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/dns-message")
-	req.Header.Set("Accept", "application/dns-message")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("DoH 请求失败: %w", err)
-	}
-	defer resp.Body.Close() //nolint:errcheck
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("DoH 响应错误: %d", resp.StatusCode)
-	}
-
-	return io.ReadAll(resp.Body)
-}
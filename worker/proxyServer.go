@@ -1,47 +1,197 @@
 package worker
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
 	"github.com/newde36524/ew/utils/log"
 
 	"net"
+	"sync"
+	"time"
+
+	"github.com/newde36524/ew/utils"
 )
 
 type ProxyServer struct {
-	listenAddr   string
-	clientConfig *ProxyClientConfig
-	IPLoader     *IPLoader
-	Ech          *Ech
+	listenAddr string
+	servers    []*ProxyClientConfig
+	IPLoader   *IPLoader
+	Auth       UserAuth // SOCKS5 / HTTP 入口的认证用户，nil 为不认证
+	RedirAddr  string   // REDIRECT 透明代理监听地址（仅 Linux，为空则不启用）
+	TProxyAddr string   // TPROXY 透明代理监听地址（仅 Linux，为空则不启用）
+	Tun        *TunConfig
+	DNS        *DNSConfig
+	Pool       WSPoolConfig // 预热连接池，MinIdle 为 0 时不启用
+	EarlyData  bool         // SOCKS5 先回复成功，将客户端首包随 CONNECT 发送（需要新版 _worker.js）
+	Timeouts   TimeoutConfig
+	Bandwidth  BandwidthConfig
+	ConnLimit  ConnLimitConfig
+	Quota      QuotaConfig
+	StatsFile  string // 流量统计文件，为空则不保存
+	APIAddr    string // 管理 API 监听地址，为空则不启用
+	Coalesce   CoalesceConfig
+	Compress   CompressionMode
+	framePool  *sync.Pool
+	resolver   *Resolver
+	stats      *TrafficStats
+	bandwidth  *bandwidthLimiter
+	connLimit  *connLimiter
+	proxiedDoH *utils.DoHClient // 经 ECH 访问 Cloudflare DoH，代理域名的上游
+
+	quotaWarning quotaDirectWarning
+}
+
+// TunConfig TUN 入口配置（仅 Linux）
+type TunConfig struct {
+	Name      string // 设备名，为空则不启用
+	Addr      string // 设备地址（CIDR）
+	MTU       int
+	AutoRoute bool // 自动配置策略路由，将默认流量导入 TUN
 }
 
 type ProxyClientConfig struct {
 	ServerAddr string
 	ServerIP   string
 	Token      string
+	SNI        string    // 内层 SNI（与 WebSocket Host 一致）
+	DoHHost    string    // 经该服务端查询 DNS 时使用的 DoH 主机
+	ECHPolicy  ECHPolicy // ECH 策略，决定 ECH 不可用时是否退回普通 TLS
+	Ech        *Ech
+	DailyQuota int        // 每日 WebSocket 连接数配额，0 使用 ProxyServer.Quota.Daily
+	pool       *wsPool    // 预热的空闲隧道连接，未启用时为 nil
+	quota      *dialQuota // 当日连接计数
+	compress   bool       // WebSocket 握手时协商 permessage-deflate
 }
 
-func NewProxyServer(listenAddr string, clientConfig *ProxyClientConfig, ipLoader *IPLoader, ech *Ech) *ProxyServer {
+func NewProxyServer(listenAddr string, servers []*ProxyClientConfig, ipLoader *IPLoader) *ProxyServer {
 	return &ProxyServer{
-		listenAddr:   listenAddr,
-		clientConfig: clientConfig,
-		IPLoader:     ipLoader,
-		Ech:          ech,
+		listenAddr: listenAddr,
+		servers:    servers,
+		IPLoader:   ipLoader,
 	}
 }
 
 func (p *ProxyServer) Run() error {
+	if p.Tun != nil && len(p.Tun.Name) != 0 {
+		// 后续的 ECH 查询、预热连接、DNS 上游都要带上标记，否则启用自动路由后会被路由回 TUN
+		p.markTunOutbound()
+	}
 	log.Printf("[启动] 正在获取 ECH 配置...")
-	if err := p.Ech.PrepareECH(); err != nil {
-		log.Fatalf("[启动] 获取 ECH 配置失败: %v", err)
+	if err := p.prepareECH(); err != nil {
+		return fmt.Errorf("获取 ECH 配置失败: %w", err)
 	}
 	p.IPLoader.LoadWithRoutingMode()
+	p.bandwidth = newBandwidthLimiter(p.Bandwidth)
+	if p.bandwidth != nil {
+		log.Printf("[限速] 上行/下行: 全局 %s，每客户端 %s，每用户 %s，代理 %s，直连 %s",
+			p.Bandwidth.Global, p.Bandwidth.Client, p.Bandwidth.User, p.Bandwidth.Proxy, p.Bandwidth.Direct)
+	}
+	if p.Auth != nil {
+		log.Printf("[认证] SOCKS5 / HTTP 入口启用用户名密码认证（%d 个用户）", len(p.Auth))
+	}
+	p.connLimit = newConnLimiter(p.ConnLimit)
+	p.framePool = newFramePool(p.Coalesce.MaxFrame)
+	if err := p.startStats(); err != nil {
+		return err
+	}
+	for _, server := range p.servers {
+		quota := server.DailyQuota
+		if quota <= 0 {
+			quota = p.Quota.Daily
+		}
+		server.quota = newDialQuota(server.ServerAddr, quota, p.Quota.Threshold)
+		server.compress = p.Compress == CompressionAuto || p.Compress == CompressionAll
+		server.pool = newWSPool(server.ServerAddr, p.Pool, func() (*utils.WebSocketWrap, error) {
+			// 配额将满时不再预热，留给实际的隧道
+			if server.quota.exhausted() {
+				return nil, errQuotaNear
+			}
+			return dialServer(server, 1)
+		})
+	}
+
+	proxiedDoH, err := p.newProxiedDoHClient()
+	if err != nil {
+		return fmt.Errorf("初始化 DoH 客户端失败: %w", err)
+	}
+	p.proxiedDoH = proxiedDoH
+
+	resolver, err := NewResolver(p.DNS, p.IPLoader, p.proxiedDoH.Exchange)
+	if err != nil {
+		return fmt.Errorf("初始化 DNS 解析器失败: %w", err)
+	}
+	p.resolver = resolver
+	if resolver.IsFakeIP() {
+		// fake-ip 模式下仅按域名分流，不做解析
+		p.IPLoader.SetResolver(nil)
+	} else {
+		p.IPLoader.SetResolver(resolver.LookupIP)
+	}
+	if len(p.DNS.Listen) != 0 {
+		if err := resolver.Serve(p.DNS.Listen); err != nil {
+			return err
+		}
+	}
+
+	if len(p.RedirAddr) != 0 {
+		if err := p.runRedirServer(); err != nil {
+			return err
+		}
+	}
+	if len(p.TProxyAddr) != 0 {
+		if err := p.runTProxyServer(); err != nil {
+			return err
+		}
+	}
+	if p.Tun != nil && len(p.Tun.Name) != 0 {
+		if err := p.runTunServer(); err != nil {
+			return err
+		}
+	}
 
 	return p.runProxyServer()
 }
 
+// setupFraming 设置隧道的写合并与压缩
+func (p *ProxyServer) setupFraming(proxyClient *ProxyClient) {
+	proxyClient.coalescer.window = p.Coalesce.Window
+	proxyClient.framePool = p.framePool
+	proxyClient.compression = p.Compress
+}
+
+// startStats 加载流量统计并定期保存（退出时再保存一次），按需启动管理 API
+//
+// 既不保存也不提供 API 时不统计
+func (p *ProxyServer) startStats() error {
+	if len(p.StatsFile) == 0 && len(p.APIAddr) == 0 {
+		return nil
+	}
+	stats, err := NewTrafficStats(p.StatsFile)
+	if err != nil {
+		return err
+	}
+	p.stats = stats
+	stop := make(chan struct{})
+	go stats.autoSave(stop) // 未指定文件时只清理过期记录
+	utils.OnExit(func() {
+		close(stop)
+		if err := stats.Save(); err != nil {
+			log.Printf("[统计] %v", err)
+		}
+	})
+	if len(p.APIAddr) != 0 {
+		return p.runAPIServer()
+	}
+	return nil
+}
+
 func (p *ProxyServer) runProxyServer() error {
 	listener, err := net.Listen("tcp", p.listenAddr)
 	if err != nil {
-		log.Fatalf("[代理] 监听失败: %v", err)
+		return fmt.Errorf("代理监听失败: %w", err)
 	}
 	defer listener.Close() //nolint:errcheck
 
@@ -50,9 +200,11 @@ func (p *ProxyServer) runProxyServer() error {
 	// //关闭控制台日志输出提升性能
 	// log.Default().SetOutput(io.Discard)
 
-	log.Printf("[代理] 后端服务器: %s", p.clientConfig.ServerAddr)
-	if len(p.clientConfig.ServerIP) != 0 {
-		log.Printf("[代理] 使用固定 IP: %s", p.clientConfig.ServerIP)
+	for _, server := range p.servers {
+		log.Printf("[代理] 后端服务器: %s (SNI: %s)", server.ServerAddr, server.SNI)
+		if len(server.ServerIP) != 0 {
+			log.Printf("[代理] 使用固定 IP: %s", server.ServerIP)
+		}
 	}
 
 	for {
@@ -68,8 +220,21 @@ func (p *ProxyServer) runProxyServer() error {
 
 func (p *ProxyServer) handleConnection(conn net.Conn) {
 	defer conn.Close() //nolint:errcheck
+	setKeepAlive(conn, p.Timeouts.KeepAlive)
 
-	proxyClient := NewProxyClient(conn, conn.RemoteAddr().String(), p.clientConfig, p.IPLoader, p.Ech)
+	proxyClient := NewProxyClient(conn, conn.RemoteAddr().String(), p.servers, p.IPLoader)
+	proxyClient.auth = p.Auth
+	proxyClient.resolver = p.resolver
+	proxyClient.earlyData = p.EarlyData
+	proxyClient.timeouts = p.Timeouts
+	proxyClient.bandwidth = p.bandwidth
+	proxyClient.connLimit = p.connLimit
+	proxyClient.quotaAction = p.Quota.Action
+	proxyClient.quotaWarning = &p.quotaWarning
+	proxyClient.stats = p.stats
+	p.setupFraming(proxyClient)
+	proxyClient.startHandshake()
+	defer proxyClient.logHandshakeTimeout()
 
 	// 使用 switch 判断协议类型
 	firstByte := proxyClient.ReadFirstByte()
@@ -84,3 +249,138 @@ func (p *ProxyServer) handleConnection(conn net.Conn) {
 		log.Printf("[代理] %s 未知协议: 0x%02x", proxyClient.ClientAddr(), firstByte)
 	}
 }
+
+// handleTransparent 将透明代理连接交给隧道逻辑（与 SOCKS5/HTTP 共用分流）
+func (p *ProxyServer) handleTransparent(conn net.Conn, dst *net.TCPAddr) {
+	defer conn.Close() //nolint:errcheck
+
+	setKeepAlive(conn, p.Timeouts.KeepAlive)
+
+	target := dst.String()
+	proxyClient := NewProxyClient(conn, conn.RemoteAddr().String(), p.servers, p.IPLoader)
+	proxyClient.resolver = p.resolver
+	proxyClient.timeouts = p.Timeouts
+	proxyClient.bandwidth = p.bandwidth
+	proxyClient.connLimit = p.connLimit
+	proxyClient.quotaAction = p.Quota.Action
+	proxyClient.quotaWarning = &p.quotaWarning
+	proxyClient.stats = p.stats
+	p.setupFraming(proxyClient)
+	log.Printf("[透明代理] %s -> %s", proxyClient.ClientAddr(), target)
+
+	if err := proxyClient.handleTunnel(target, utils.ModeTransparent, ""); err != nil {
+		if !utils.IsNormalCloseError(err) {
+			log.Printf("[透明代理] %s 代理失败: %v", proxyClient.ClientAddr(), err)
+		}
+	}
+}
+
+// prepareECH 获取各服务端的 ECH 配置（共用的配置只获取一次），至少一个服务端可用即可启动
+//
+// disabled 策略的服务端不获取；preferred 策略的服务端获取失败时仍可使用普通 TLS
+func (p *ProxyServer) prepareECH() error {
+	var lastErr error
+	usable := false
+	prepared := map[*Ech]error{}
+	for _, server := range p.servers {
+		if !server.ECHPolicy.useECH() {
+			log.Printf("[启动] 服务端 %s 不使用 ECH（策略: %s）", server.ServerAddr, server.ECHPolicy)
+			usable = true
+			continue
+		}
+		err, ok := prepared[server.Ech]
+		if !ok {
+			err = server.Ech.PrepareECH()
+			prepared[server.Ech] = err
+			if err == nil {
+				if status, ok := server.Ech.Status(); ok {
+					log.Printf("[启动] 服务端 %s ECH 配置状态: %s", server.ServerAddr, status)
+				}
+			}
+		}
+		switch {
+		case err == nil:
+			usable = true
+		case server.ECHPolicy == ECHPreferred:
+			log.Printf("[启动] 服务端 %s 获取 ECH 配置失败，将使用普通 TLS: %v", server.ServerAddr, err)
+			usable = true
+		default:
+			log.Printf("[启动] 服务端 %s 获取 ECH 配置失败: %v", server.ServerAddr, err)
+			lastErr = err
+		}
+	}
+	if usable {
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("未配置服务端")
+	}
+	return lastErr
+}
+
+// newProxiedDoHClient 创建经服务端访问 DoH 的客户端（使用第一个可用服务端的端口、固定 IP 与 ECH 配置）
+func (p *ProxyServer) newProxiedDoHClient() (*utils.DoHClient, error) {
+	server := p.servers[0]
+	for _, s := range p.servers {
+		if _, ok := s.Ech.Status(); ok || s.ECHPolicy != ECHRequired {
+			server = s
+			break
+		}
+	}
+	_, port, _, err := utils.ParseServerAddr(server.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	dohAddr := net.JoinHostPort(server.DoHHost, port)
+
+	dialer := utils.NewDialer(10 * time.Second)
+	transport := utils.NewDoHTransport()
+	// 每个新连接都取当前的 ECH 配置，ECH 刷新后无需重建客户端
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if len(server.ServerIP) != 0 {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			addr = net.JoinHostPort(server.ServerIP, port)
+		}
+		tlsCfg, _, err := server.TLSConfig(server.DoHHost)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialTLSConn(ctx, dialer, network, addr, tlsCfg)
+		switch {
+		case err == nil:
+		case server.Ech.HandleRejection(err):
+			// 服务器拒绝 ECH 并提供了重试配置时立即重连一次
+			if tlsCfg, _, err = server.TLSConfig(server.DoHHost); err != nil {
+				return nil, err
+			}
+			conn, err = dialTLSConn(ctx, dialer, network, addr, tlsCfg)
+		case server.fallbackToPlain(err):
+			log.Printf("[ECH] 服务端 %s 未启用 ECH，DoH 退回普通 TLS", server.ServerAddr)
+			if tlsCfg, err = utils.BuildTLS13Config(server.DoHHost); err != nil {
+				return nil, err
+			}
+			conn, err = dialTLSConn(ctx, dialer, network, addr, tlsCfg)
+		}
+		return conn, err
+	}
+	return utils.NewDoHClient([]string{fmt.Sprintf("https://%s/dns-query", dohAddr)}, transport), nil
+}
+
+// dialTLSConn 建立 TLS 连接（支持 HTTP/2）
+func dialTLSConn(ctx context.Context, dialer *net.Dialer, network, addr string, tlsCfg *tls.Config) (net.Conn, error) {
+	rawConn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg = tlsCfg.Clone()
+	tlsCfg.NextProtos = []string{"h2", "http/1.1"}
+	tlsConn := tls.Client(rawConn, tlsCfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		rawConn.Close() //nolint:errcheck
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,133 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/newde36524/ew/utils/log"
+)
+
+// QuotaAction 所有服务端的每日配额都将用尽时的处理方式
+type QuotaAction string
+
+const (
+	QuotaFailover QuotaAction = "failover" // 优先使用配额未满的服务端，都将用尽时仍继续使用
+	QuotaDirect   QuotaAction = "direct"   // 优先使用配额未满的服务端，都将用尽时改为直连
+)
+
+// QuotaConfig 每个服务端每日 WebSocket 连接数（即 Worker 请求数）的配额
+type QuotaConfig struct {
+	Daily     int         // 每日配额，服务端未单独配置时使用，0 为不限制
+	Threshold float64     // 用量达到配额的该比例时视为将满
+	Action    QuotaAction // 都将用尽时的处理方式
+}
+
+var errQuotaNear = errors.New("今日连接数接近配额")
+
+// ParseQuotaAction 解析配额处理方式，空字符串为 failover
+func ParseQuotaAction(s string) (QuotaAction, error) {
+	switch action := QuotaAction(s); action {
+	case "":
+		return QuotaFailover, nil
+	case QuotaFailover, QuotaDirect:
+		return action, nil
+	default:
+		return "", fmt.Errorf("未知的配额处理方式: %s（可选 failover、direct）", s)
+	}
+}
+
+// quotaDirectWarning 所有服务端接近配额、改为直连时的警告，每个 UTC 日只输出一次
+type quotaDirectWarning struct {
+	mu  sync.Mutex
+	day string
+}
+
+// warn 当日第一次改为直连时输出警告
+func (w *quotaDirectWarning) warn() {
+	if w == nil {
+		return
+	}
+	day := time.Now().UTC().Format(time.DateOnly)
+	w.mu.Lock()
+	first := w.day != day
+	w.day = day
+	w.mu.Unlock()
+	if first {
+		log.Printf("[警告] 所有服务端今日连接数接近配额，需要代理的连接改为直连（目标可见本机真实 IP），直到 UTC 零点配额重置")
+	}
+}
+
+// dialQuota 服务端当日的 WebSocket 连接计数，按 UTC 日期重置（与 Cloudflare 的每日限额一致）
+type dialQuota struct {
+	name  string
+	limit int // 每日配额，0 为只计数不限制
+	near  int // 将满的阈值
+
+	mu     sync.Mutex
+	day    string
+	count  int
+	warned bool
+}
+
+func newDialQuota(name string, limit int, threshold float64) *dialQuota {
+	q := &dialQuota{name: name, limit: limit}
+	if limit > 0 {
+		if threshold <= 0 || threshold > 1 {
+			threshold = 1
+		}
+		q.near = max(int(float64(limit)*threshold), 1)
+	}
+	return q
+}
+
+// rollover 日期变化时重置计数，需持有锁
+func (q *dialQuota) rollover() {
+	if day := time.Now().UTC().Format(time.DateOnly); day != q.day {
+		q.day = day
+		q.count = 0
+		q.warned = false
+	}
+}
+
+// add 记录一次到达 Worker 的 WebSocket 连接
+func (q *dialQuota) add() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.rollover()
+	q.count++
+	warn := q.limit > 0 && q.count >= q.near && !q.warned
+	if warn {
+		q.warned = true
+	}
+	count := q.count
+	q.mu.Unlock()
+	if warn {
+		log.Printf("[配额] 服务端 %s 今日连接数 %d/%d，接近配额", q.name, count, q.limit)
+	}
+}
+
+// exhausted 今日用量是否已达到将满的阈值
+func (q *dialQuota) exhausted() bool {
+	if q == nil || q.limit <= 0 {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	return q.count >= q.near
+}
+
+// usage 今日连接数与配额
+func (q *dialQuota) usage() (count, limit int) {
+	if q == nil {
+		return 0, 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	return q.count, q.limit
+}
@@ -0,0 +1,215 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/newde36524/ew/utils"
+)
+
+// newFakeWorker 模拟 _worker.js 的隧道协议：回复 CONNECTED 后原样回显数据；
+// v2 收到 FIN 时回复 FIN，v1 收到 CLOSE 时关闭连接
+func newFakeWorker(t *testing.T) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := utils.TunnelV1
+		header := http.Header{}
+		if r.Header.Get(utils.TunnelVersionHeader) == strconv.Itoa(utils.TunnelV2) {
+			version = utils.TunnelV2
+			header.Set(utils.TunnelVersionHeader, strconv.Itoa(utils.TunnelV2))
+		}
+		conn, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+		// CONNECT
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		if version == utils.TunnelV2 {
+			err = conn.WriteMessage(websocket.BinaryMessage, []byte{0x02})
+		} else {
+			err = conn.WriteMessage(websocket.TextMessage, []byte("CONNECTED"))
+		}
+		if err != nil {
+			return
+		}
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if version == utils.TunnelV1 && mt == websocket.TextMessage && string(msg) == "CLOSE" {
+				return
+			}
+			if version == utils.TunnelV2 && len(msg) != 0 && msg[0] == 0x04 { // CLOSE
+				return
+			}
+			if err := conn.WriteMessage(mt, msg); err != nil { // DATA 与 FIN 原样返回
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dialFakeWorker 连接模拟 Worker 并发送 CONNECT
+func dialFakeWorker(t *testing.T, server *httptest.Server, version int) *utils.WebSocketWrap {
+	header := http.Header{utils.TunnelVersionHeader: []string{strconv.Itoa(version)}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	ws := utils.NewWebSocketWrap(conn, utils.NegotiatedTunnelVersion(resp))
+	if err := ws.SendConnect("example.com:443", nil, utils.ModeHTTPConnect); err != nil {
+		ws.Close() //nolint:errcheck
+		t.Error(err)
+		return nil
+	}
+	return ws
+}
+
+// tcpPair 建立一对本地 TCP 连接
+func tcpPair(t *testing.T, listener net.Listener) (client, server net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		<-accepted
+		return nil, nil
+	}
+	server = <-accepted
+	if server == nil {
+		client.Close() //nolint:errcheck
+		t.Error("accept 失败")
+		return nil, nil
+	}
+	return client, server
+}
+
+// runTunnel 通过 relay 转发一条隧道；kind 为客户端的行为：0 正常半关闭，1 中途直接关闭，2 由隧道空闲超时拆除
+func runTunnel(t *testing.T, worker *httptest.Server, listener net.Listener, version, kind int) {
+	client, conn := tcpPair(t, listener)
+	if client == nil {
+		return
+	}
+	defer client.Close() //nolint:errcheck
+	ws := dialFakeWorker(t, worker, version)
+	if ws == nil {
+		conn.Close() //nolint:errcheck
+		return
+	}
+	go ws.KeepAlive()
+
+	p := &ProxyClient{Conn: conn, wsConn: ws, clientAddr: client.LocalAddr().String()}
+	if kind == 2 {
+		p.timeouts.Idle = 200 * time.Millisecond
+	}
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		p.relay(context.Background()) //nolint:errcheck
+		conn.Close()                  //nolint:errcheck
+	}()
+
+	payload := []byte("ping")
+	if _, err := client.Write(payload); err != nil {
+		t.Error(err)
+	}
+	echo := make([]byte, len(payload))
+	if _, err := io.ReadFull(client, echo); err != nil || !bytes.Equal(echo, payload) {
+		t.Errorf("回显 %q, %v", echo, err)
+	}
+	switch kind {
+	case 0:
+		client.(*net.TCPConn).CloseWrite() //nolint:errcheck
+		io.Copy(io.Discard, client)        //nolint:errcheck
+	case 1:
+		client.Close() //nolint:errcheck
+	}
+	select {
+	case <-relayDone:
+	case <-time.After(10 * time.Second):
+		t.Error("relay 未返回")
+	}
+}
+
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// TestRelayNoLeak 大量隧道结束后，协程数与打开的文件描述符数应回到基线
+func TestRelayNoLeak(t *testing.T) {
+	worker := newFakeWorker(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close() //nolint:errcheck
+
+	tunnels := 3000
+	if testing.Short() {
+		tunnels = 300
+	}
+	// 预热一条隧道，使 httptest 与运行时的常驻协程计入基线
+	runTunnel(t, worker, listener, utils.TunnelV2, 0)
+	time.Sleep(100 * time.Millisecond)
+	baseGoroutines, baseFDs := runtime.NumGoroutine(), openFDs()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 64)
+	for i := 0; i < tunnels; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			version := utils.TunnelV1 + i%2
+			runTunnel(t, worker, listener, version, i/2%3)
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// 服务端处理协程与连接关闭是异步的，等待回落
+	var goroutines, fds int
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		goroutines, fds = runtime.NumGoroutine(), openFDs()
+		if goroutines <= baseGoroutines && fds <= baseFDs {
+			return
+		}
+	}
+	buf := make([]byte, 1<<20)
+	t.Fatalf("泄漏: 协程 %d -> %d，文件描述符 %d -> %d\n%s",
+		baseGoroutines, goroutines, baseFDs, fds, buf[:runtime.Stack(buf, true)])
+}
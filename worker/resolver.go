@@ -0,0 +1,307 @@
+package worker
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newde36524/ew/utils"
+	"github.com/newde36524/ew/utils/log"
+)
+
+// DNS 模式
+const (
+	DNSModeRedirHost = "redir-host" // 返回真实地址，并记录地址与域名的对应关系
+	DNSModeFakeIP    = "fake-ip"    // 非国内域名返回虚假地址，连接时还原域名，不做解析
+)
+
+const (
+	fakeIPTTL     = 1    // fake-ip 应答的 TTL（秒）
+	hostTableSize = 8192 // redir-host 模式下保留的地址映射数量
+)
+
+// DNSConfig 内置 DNS 配置
+type DNSConfig struct {
+	Listen      string             // 监听地址（UDP+TCP），为空则不启动 DNS 服务
+	Mode        string             // redir-host / fake-ip
+	Domestic    utils.DNSExchanger // 国内域名使用的 DNS 上游
+	FakeIPRange string             // fake-ip 地址段
+	CacheSize   int                // 缓存记录数，0 为不缓存
+	MinTTL      time.Duration      // 缓存最短时间
+	MaxTTL      time.Duration      // 缓存最长时间
+}
+
+// Resolver 分流 DNS 解析器：国内域名走国内上游，其它域名经 ECH 隧道走代理 DoH
+type Resolver struct {
+	mode     string
+	domestic utils.DNSExchanger
+	ipLoader *IPLoader
+	proxied  func(query []byte) ([]byte, error)
+	fakeIP   *FakeIPPool
+	hosts    *hostTable
+	cache    *utils.DNSCache
+}
+
+func NewResolver(cfg *DNSConfig, ipLoader *IPLoader, proxied func(query []byte) ([]byte, error)) (*Resolver, error) {
+	r := &Resolver{
+		mode:     cfg.Mode,
+		domestic: cfg.Domestic,
+		ipLoader: ipLoader,
+		proxied:  proxied,
+		hosts:    newHostTable(hostTableSize),
+	}
+	if cfg.CacheSize > 0 {
+		r.cache = utils.NewDNSCache(cfg.CacheSize, cfg.MinTTL, cfg.MaxTTL)
+	}
+	switch cfg.Mode {
+	case DNSModeFakeIP:
+		pool, err := NewFakeIPPool(cfg.FakeIPRange)
+		if err != nil {
+			return nil, err
+		}
+		r.fakeIP = pool
+	case DNSModeRedirHost:
+	default:
+		return nil, fmt.Errorf("未知的 DNS 模式: %s", cfg.Mode)
+	}
+	return r, nil
+}
+
+// IsFakeIP 是否为 fake-ip 模式
+func (r *Resolver) IsFakeIP() bool {
+	return r.fakeIP != nil
+}
+
+// Exchange 处理一个原始 DNS 查询报文
+func (r *Resolver) Exchange(query []byte) ([]byte, error) {
+	msg, err := utils.ParseDNSMessage(query)
+	if err != nil {
+		return nil, fmt.Errorf("解析 DNS 查询失败: %w", err)
+	}
+	return r.exchange(msg, query)
+}
+
+// Respond 处理 DNS 查询并返回发给客户端的应答：查询失败时 err 非 nil，resp 为带回 ID 与问题段的
+// SERVFAIL（缺少问题段时为 FORMERR），使客户端立即重试或换用其他服务器而不是等待超时；
+// 查询报文无法解析时 resp 为 nil
+func (r *Resolver) Respond(query []byte) (resp []byte, err error) {
+	msg, err := utils.ParseDNSMessage(query)
+	if err != nil {
+		return nil, fmt.Errorf("解析 DNS 查询失败: %w", err)
+	}
+	resp, err = r.exchange(msg, query)
+	if err == nil {
+		return resp, nil
+	}
+	reply := msg.Reply()
+	reply.RCode = utils.RCodeServerFailure
+	if len(msg.Questions) == 0 {
+		reply.RCode = utils.RCodeFormatError
+	}
+	resp, packErr := reply.Pack()
+	if packErr != nil {
+		return nil, err
+	}
+	return resp, err
+}
+
+func (r *Resolver) exchange(msg *utils.DNSMessage, query []byte) ([]byte, error) {
+	question, ok := msg.Question()
+	if !ok {
+		return nil, errors.New("DNS 查询缺少问题段")
+	}
+	name := strings.ToLower(question.Name)
+	domestic := r.ipLoader.IsChinaDomain(name)
+
+	// fake-ip 模式下国内域名仍返回真实地址，方便直连
+	if r.fakeIP != nil && !domestic && (question.Type == utils.TypeA || question.Type == utils.TypeAAAA) {
+		reply := msg.Reply()
+		// AAAA 返回空应答，引导客户端使用 IPv4 虚假地址
+		if question.Type == utils.TypeA {
+			reply.Answers = append(reply.Answers, utils.DNSRecord{
+				Name:  question.Name,
+				Type:  utils.TypeA,
+				Class: utils.ClassINET,
+				TTL:   fakeIPTTL,
+				Data:  &utils.DNSAddress{IP: r.fakeIP.Alloc(name)},
+			})
+		}
+		return reply.Pack()
+	}
+
+	resp, err := r.exchangeUpstream(query, domestic)
+	if err != nil {
+		return nil, err
+	}
+	if answer, err := utils.ParseDNSMessage(resp); err == nil {
+		for _, ip := range answer.IPs() {
+			r.hosts.Set(ip, name)
+		}
+	}
+	return resp, nil
+}
+
+// LookupIP 解析域名的真实地址（不经过 fake-ip），用于按 IP 分流
+func (r *Resolver) LookupIP(domain string) ([]net.IP, error) {
+	domestic := r.ipLoader.IsChinaDomain(domain)
+	var lastErr error
+	for _, qtype := range []uint16{utils.TypeA, utils.TypeAAAA} {
+		query, err := utils.NewDNSQuery(domain, qtype).Pack()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := r.exchangeUpstream(query, domestic)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		answer, err := utils.ParseDNSMessage(resp)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ips := answer.IPs(); len(ips) != 0 {
+			return ips, nil
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, errors.New("无解析结果")
+}
+
+// LookupHost 将连接的目标地址还原为域名（fake-ip 记录；redirHost 为 true 时也查 redir-host 记录）
+func (r *Resolver) LookupHost(ip net.IP, redirHost bool) (string, bool) {
+	if r.fakeIP != nil {
+		if domain, ok := r.fakeIP.Lookup(ip); ok {
+			return domain, true
+		}
+	}
+	if !redirHost {
+		return "", false
+	}
+	return r.hosts.Get(ip)
+}
+
+// exchangeUpstream 经缓存向对应的上游查询
+func (r *Resolver) exchangeUpstream(query []byte, domestic bool) ([]byte, error) {
+	if domestic {
+		return r.cache.Exchange(query, r.domestic.Exchange)
+	}
+	return r.cache.Exchange(query, r.proxied)
+}
+
+// Serve 在指定地址启动 DNS 服务（UDP + TCP）
+func (r *Resolver) Serve(addr string) error {
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("DNS UDP 监听失败: %w", err)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		packetConn.Close() //nolint:errcheck
+		return fmt.Errorf("DNS TCP 监听失败: %w", err)
+	}
+	log.Printf("[DNS] 服务启动: %s (模式: %s)", addr, r.mode)
+
+	go r.serveUDP(packetConn)
+	go r.serveTCP(listener)
+	return nil
+}
+
+func (r *Resolver) serveUDP(conn net.PacketConn) {
+	defer conn.Close() //nolint:errcheck
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("[DNS] UDP 读取失败: %v", err)
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp, err := r.Respond(query)
+			if err != nil {
+				log.Printf("[DNS] %s 查询失败: %v", addr, err)
+			}
+			if resp != nil {
+				conn.WriteTo(resp, addr) //nolint:errcheck
+			}
+		}()
+	}
+}
+
+func (r *Resolver) serveTCP(listener net.Listener) {
+	defer listener.Close() //nolint:errcheck
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("[DNS] 接受连接失败: %v", err)
+			continue
+		}
+		go func() {
+			defer conn.Close() //nolint:errcheck
+			lenBuf := make([]byte, 2)
+			for {
+				if _, err := io.ReadFull(conn, lenBuf); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(lenBuf))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp, err := r.Respond(query)
+				if err != nil {
+					log.Printf("[DNS] %s 查询失败: %v", conn.RemoteAddr(), err)
+				}
+				if resp == nil {
+					return
+				}
+				if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// hostTable 记录解析结果中地址与域名的对应关系，超出容量时淘汰最早的记录
+type hostTable struct {
+	mu    sync.Mutex
+	hosts map[string]string
+	order []string
+	head  int
+}
+
+func newHostTable(size int) *hostTable {
+	return &hostTable{
+		hosts: make(map[string]string, size),
+		order: make([]string, size),
+	}
+}
+
+func (h *hostTable) Set(ip net.IP, domain string) {
+	key := ip.String()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.hosts[key]; !ok {
+		if old := h.order[h.head]; len(old) != 0 {
+			delete(h.hosts, old)
+		}
+		h.order[h.head] = key
+		h.head = (h.head + 1) % len(h.order)
+	}
+	h.hosts[key] = domain
+}
+
+func (h *hostTable) Get(ip net.IP) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	domain, ok := h.hosts[ip.String()]
+	return domain, ok
+}
@@ -0,0 +1,75 @@
+package worker
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/newde36524/ew/utils"
+)
+
+func newTestResolver(t *testing.T, mode string, proxied func(query []byte) ([]byte, error)) *Resolver {
+	t.Helper()
+	r, err := NewResolver(&DNSConfig{Mode: mode, FakeIPRange: "198.19.0.0/16"}, NewIPLoader(None), proxied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// TestResolverRespondServFail 上游失败时回复带回 ID 与问题段的 SERVFAIL
+func TestResolverRespondServFail(t *testing.T) {
+	r := newTestResolver(t, DNSModeRedirHost, func([]byte) ([]byte, error) {
+		return nil, errors.New("upstream down")
+	})
+	query := utils.NewDNSQuery("example.com", utils.TypeA)
+	query.ID = 0x1234
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := r.Respond(packed)
+	if err == nil {
+		t.Fatal("上游失败时应返回错误")
+	}
+	reply, parseErr := utils.ParseDNSMessage(resp)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	question, _ := reply.Question()
+	if !reply.Response || reply.ID != 0x1234 || reply.RCode != utils.RCodeServerFailure || question.Name != "example.com" || question.Type != utils.TypeA {
+		t.Errorf("应答 = %+v", reply)
+	}
+
+	// 缺少问题段时回复 FORMERR
+	empty, _ := (&utils.DNSMessage{ID: 7}).Pack()
+	resp, err = r.Respond(empty)
+	if reply, parseErr := utils.ParseDNSMessage(resp); err == nil || parseErr != nil || reply.ID != 7 || reply.RCode != utils.RCodeFormatError {
+		t.Errorf("缺少问题段: %v, %v, %+v", err, parseErr, reply)
+	}
+
+	// 无法解析的报文不回复
+	if resp, err := r.Respond([]byte{0x12}); resp != nil || err == nil {
+		t.Errorf("无法解析的报文: %x, %v", resp, err)
+	}
+}
+
+// TestResolverLookupHost redir-host 记录只在 redirHost 为 true 时使用，fake-ip 记录始终还原
+func TestResolverLookupHost(t *testing.T) {
+	r := newTestResolver(t, DNSModeRedirHost, nil)
+	ip := net.ParseIP("93.184.216.34")
+	r.hosts.Set(ip, "example.com")
+	if domain, ok := r.LookupHost(ip, true); !ok || domain != "example.com" {
+		t.Errorf("透明代理应还原 redir-host 记录: %q, %v", domain, ok)
+	}
+	if domain, ok := r.LookupHost(ip, false); ok {
+		t.Errorf("SOCKS5 / HTTP 不应还原 redir-host 记录: %q", domain)
+	}
+
+	r = newTestResolver(t, DNSModeFakeIP, nil)
+	fake := r.fakeIP.Alloc("example.org")
+	if domain, ok := r.LookupHost(fake, false); !ok || domain != "example.org" {
+		t.Errorf("fake-ip 地址应始终还原: %q, %v", domain, ok)
+	}
+}
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/newde36524/ew/utils"
+)
+
+// ServerConfig 配置文件（-config）中的一个服务端
+//
+// ECH 来源三选一：ech_domain（DNS 查询）、ech_config（固定 base64）、ech_file（文件），
+// 都为空时使用 -ech 指定的查询域名
+type ServerConfig struct {
+	Addr       string `json:"addr"`        // 服务端地址 host:port[/path]
+	IP         string `json:"ip"`          // 固定连接的 IP（绕过 DNS 解析）
+	Token      string `json:"token"`       // 身份验证令牌
+	SNI        string `json:"sni"`         // 内层 SNI，默认取 addr 的主机名
+	PublicName string `json:"public_name"` // 外层 SNI，只使用 public_name 与之相同的 ECHConfig
+	ECHDomain  string `json:"ech_domain"`  // 通过 DNS 查询 HTTPS 记录的域名
+	ECHConfig  string `json:"ech_config"`  // 固定的 ECHConfigList（base64）
+	ECHFile    string `json:"ech_file"`    // 保存 ECHConfigList 的文件
+	DoHHost    string `json:"doh_host"`    // 经该服务端查询 DNS 时使用的 DoH 主机，默认 cloudflare-dns.com
+	ECHPolicy  string `json:"ech_policy"`  // ECH 策略: required、preferred、disabled，默认取 -ech-policy
+	DailyQuota int    `json:"daily_quota"` // 每日 WebSocket 连接数配额，0 取 -daily-quota
+}
+
+// LoadServerConfigs 读取服务端配置文件（JSON 数组）
+func LoadServerConfigs(path string) ([]ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %w", err)
+	}
+	var servers []ServerConfig
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %w", err)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("配置文件中没有服务端")
+	}
+	return servers, nil
+}
+
+// NewProxyClientConfigs 按配置创建服务端列表，ECH 来源相同的服务端共用一个 Ech
+func NewProxyClientConfigs(servers []ServerConfig, dns utils.DNSExchanger, defaultECHDomain string, defaultPolicy ECHPolicy) ([]*ProxyClientConfig, error) {
+	echs := map[ServerConfig]*Ech{}
+	configs := make([]*ProxyClientConfig, 0, len(servers))
+	for _, server := range servers {
+		host, _, _, err := utils.ParseServerAddr(server.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("服务端 %s: %w", server.Addr, err)
+		}
+		policy := defaultPolicy
+		if len(server.ECHPolicy) != 0 {
+			if policy, err = ParseECHPolicy(server.ECHPolicy); err != nil {
+				return nil, fmt.Errorf("服务端 %s: %w", server.Addr, err)
+			}
+		}
+		source := ServerConfig{
+			PublicName: server.PublicName,
+			ECHDomain:  server.ECHDomain,
+			ECHConfig:  server.ECHConfig,
+			ECHFile:    server.ECHFile,
+		}
+		ech, ok := echs[source]
+		if !ok {
+			switch {
+			case len(server.ECHConfig) != 0:
+				if ech, err = NewStaticEch(server.ECHConfig); err != nil {
+					return nil, fmt.Errorf("服务端 %s: %w", server.Addr, err)
+				}
+			case len(server.ECHFile) != 0:
+				ech = NewFileEch(server.ECHFile)
+			case len(server.ECHDomain) != 0:
+				ech = NewEch(dns, server.ECHDomain)
+			default:
+				ech = NewEch(dns, defaultECHDomain)
+			}
+			ech.PublicName = server.PublicName
+			echs[source] = ech
+		}
+
+		config := &ProxyClientConfig{
+			ServerAddr: server.Addr,
+			ServerIP:   server.IP,
+			Token:      server.Token,
+			SNI:        server.SNI,
+			DoHHost:    server.DoHHost,
+			ECHPolicy:  policy,
+			Ech:        ech,
+			DailyQuota: server.DailyQuota,
+		}
+		if len(config.SNI) == 0 {
+			config.SNI = host
+		}
+		if len(config.DoHHost) == 0 {
+			config.DoHHost = proxiedDoHHost
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
@@ -0,0 +1,376 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/newde36524/ew/utils/log"
+)
+
+// 统计保留的天数与月数，更早的记录在保存时清理
+const (
+	statsKeepDays   = 62
+	statsKeepMonths = 24
+
+	statsSaveInterval  = time.Minute
+	statsFlushInterval = 10 * time.Second // 连接的流量累计到统计的间隔
+	statsMonthLayout   = "2006-01"
+
+	// StatsDirect 直连流量在服务端维度中的名称
+	StatsDirect = "direct"
+)
+
+// Usage 连接数与流量（字节）
+type Usage struct {
+	Connections int64 `json:"connections"`
+	Upload      int64 `json:"upload"`   // 客户端 -> 远端
+	Download    int64 `json:"download"` // 远端 -> 客户端
+}
+
+func (u *Usage) add(conns, up, down int64) {
+	u.Connections += conns
+	u.Upload += up
+	u.Download += down
+}
+
+// UsagePeriod 一个统计周期（一天或一个月）内按维度汇总的用量
+type UsagePeriod struct {
+	Total   Usage             `json:"total"`
+	Clients map[string]*Usage `json:"clients"` // 客户端 IP
+	Domains map[string]*Usage `json:"domains"` // 目标域名（无域名时为 IP）
+	Servers map[string]*Usage `json:"servers"` // 服务端地址，直连为 StatsDirect
+	Users   map[string]*Usage `json:"users"`   // 认证用户（未认证的连接不计入）
+}
+
+// StatsKey 一条连接在各维度中的取值
+type StatsKey struct {
+	Client string // 客户端 IP
+	User   string // 认证用户，空为未认证
+	Domain string // 目标域名（无域名时为 IP）
+	Server string // 服务端地址，直连为 StatsDirect
+}
+
+func newUsagePeriod() *UsagePeriod {
+	return &UsagePeriod{
+		Clients: map[string]*Usage{},
+		Domains: map[string]*Usage{},
+		Servers: map[string]*Usage{},
+		Users:   map[string]*Usage{},
+	}
+}
+
+// UsageStats 按日（2006-01-02）与按月（2006-01）汇总的用量
+type UsageStats struct {
+	Daily   map[string]*UsagePeriod `json:"daily"`
+	Monthly map[string]*UsagePeriod `json:"monthly"`
+}
+
+// TrafficStats 流量统计，定期与退出时保存到文件，重启后继续累计
+type TrafficStats struct {
+	path string
+
+	mu    sync.Mutex
+	data  UsageStats
+	dirty bool
+}
+
+// NewTrafficStats 读取已保存的统计，文件不存在时从零开始；path 为空时不保存
+func NewTrafficStats(path string) (*TrafficStats, error) {
+	s := &TrafficStats{path: path}
+	data, err := LoadUsageStats(path)
+	if err != nil {
+		return nil, err
+	}
+	s.data = data
+	return s, nil
+}
+
+// LoadUsageStats 读取统计文件，文件不存在时返回空统计
+func LoadUsageStats(path string) (UsageStats, error) {
+	stats := UsageStats{Daily: map[string]*UsagePeriod{}, Monthly: map[string]*UsagePeriod{}}
+	if len(path) == 0 {
+		return stats, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, fmt.Errorf("读取统计文件失败: %w", err)
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return stats, fmt.Errorf("解析统计文件失败: %w", err)
+	}
+	for _, periods := range []map[string]*UsagePeriod{stats.Daily, stats.Monthly} {
+		for _, period := range periods {
+			period.fill()
+		}
+	}
+	if stats.Daily == nil {
+		stats.Daily = map[string]*UsagePeriod{}
+	}
+	if stats.Monthly == nil {
+		stats.Monthly = map[string]*UsagePeriod{}
+	}
+	return stats, nil
+}
+
+// fill 补全文件中缺失的维度
+func (p *UsagePeriod) fill() {
+	if p.Clients == nil {
+		p.Clients = map[string]*Usage{}
+	}
+	if p.Domains == nil {
+		p.Domains = map[string]*Usage{}
+	}
+	if p.Servers == nil {
+		p.Servers = map[string]*Usage{}
+	}
+	if p.Users == nil {
+		p.Users = map[string]*Usage{}
+	}
+}
+
+func (p *UsagePeriod) add(key StatsKey, conns, up, down int64) {
+	p.Total.add(conns, up, down)
+	for _, dim := range []struct {
+		m   map[string]*Usage
+		key string
+	}{{p.Clients, key.Client}, {p.Domains, key.Domain}, {p.Servers, key.Server}, {p.Users, key.User}} {
+		if len(dim.key) == 0 {
+			continue
+		}
+		u, ok := dim.m[dim.key]
+		if !ok {
+			u = &Usage{}
+			dim.m[dim.key] = u
+		}
+		u.add(conns, up, down)
+	}
+}
+
+// Open 记录一条新建立的连接（nil 统计可安全调用）
+func (s *TrafficStats) Open(key StatsKey) {
+	s.record(key, 1, 0, 0)
+}
+
+// Add 累计连接的流量，计入当前的日与月（nil 统计可安全调用）
+func (s *TrafficStats) Add(key StatsKey, up, down int64) {
+	if up == 0 && down == 0 {
+		return
+	}
+	s.record(key, 0, up, down)
+}
+
+func (s *TrafficStats) record(key StatsKey, conns, up, down int64) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	day, month := now.Format(time.DateOnly), now.Format(statsMonthLayout)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range []struct {
+		periods map[string]*UsagePeriod
+		key     string
+	}{{s.data.Daily, day}, {s.data.Monthly, month}} {
+		period, ok := item.periods[item.key]
+		if !ok {
+			period = newUsagePeriod()
+			item.periods[item.key] = period
+		}
+		period.add(key, conns, up, down)
+	}
+	s.dirty = true
+}
+
+// Snapshot 返回当前统计的副本
+func (s *TrafficStats) Snapshot() UsageStats {
+	s.mu.Lock()
+	data, err := json.Marshal(s.data)
+	s.mu.Unlock()
+	var stats UsageStats
+	if err == nil {
+		json.Unmarshal(data, &stats) //nolint:errcheck
+	}
+	return stats
+}
+
+// Save 清理过期记录并写入文件（先写临时文件再替换，避免中途退出损坏文件）；未指定文件时只清理
+func (s *TrafficStats) Save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	s.prune()
+	if len(s.path) == 0 {
+		s.dirty = false
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.data)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("保存统计文件失败: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("保存统计文件失败: %w", err)
+	}
+	return nil
+}
+
+// prune 删除超出保留期的记录，需持有锁
+func (s *TrafficStats) prune() {
+	now := time.Now()
+	oldestDay := now.AddDate(0, 0, -statsKeepDays).Format(time.DateOnly)
+	oldestMonth := now.AddDate(0, -statsKeepMonths, 0).Format(statsMonthLayout)
+	for key := range s.data.Daily {
+		if key < oldestDay {
+			delete(s.data.Daily, key)
+		}
+	}
+	for key := range s.data.Monthly {
+		if key < oldestMonth {
+			delete(s.data.Monthly, key)
+		}
+	}
+}
+
+// autoSave 定期保存，直到 stop 关闭
+func (s *TrafficStats) autoSave(stop <-chan struct{}) {
+	ticker := time.NewTicker(statsSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.Printf("[统计] %v", err)
+			}
+		}
+	}
+}
+
+// PrintUsage 打印一个统计周期的汇总，各维度按总流量排序，最多显示 top 项（0 为全部）
+func PrintUsage(w io.Writer, title string, period *UsagePeriod, top int) {
+	fmt.Fprintf(w, "== %s\n", title)
+	if period == nil {
+		fmt.Fprintf(w, "无记录\n\n")
+		return
+	}
+	fmt.Fprintf(w, "合计: %s\n", period.Total)
+	for _, dim := range []struct {
+		name string
+		m    map[string]*Usage
+	}{{"客户端", period.Clients}, {"用户", period.Users}, {"目标域名", period.Domains}, {"服务端", period.Servers}} {
+		keys := make([]string, 0, len(dim.m))
+		for key := range dim.m {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := dim.m[keys[i]], dim.m[keys[j]]
+			if a.Upload+a.Download != b.Upload+b.Download {
+				return a.Upload+a.Download > b.Upload+b.Download
+			}
+			return keys[i] < keys[j]
+		})
+		if top > 0 && len(keys) > top {
+			keys = keys[:top]
+		}
+		fmt.Fprintf(w, "-- %s（%d）\n", dim.name, len(dim.m))
+		for _, key := range keys {
+			fmt.Fprintf(w, "  %-40s %s\n", key, dim.m[key])
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// connStats 一条连接的实时统计：建立后计入连接数，流量每 statsFlushInterval 累计一次，连接结束时 flush 剩余部分
+//
+// 两个转发方向可以并发调用 add
+type connStats struct {
+	stats *TrafficStats
+	key   StatsKey
+	open  sync.Once
+
+	mu       sync.Mutex
+	up, down int64 // 尚未累计的字节数
+	flushed  time.Time
+}
+
+// newConnStats 统计关闭时返回 nil（nil 可安全调用）
+func newConnStats(stats *TrafficStats, key StatsKey) *connStats {
+	if stats == nil {
+		return nil
+	}
+	return &connStats{stats: stats, key: key}
+}
+
+// add 记录转发的字节数，首次调用时计入连接数
+func (c *connStats) add(up, down int64) {
+	if c == nil {
+		return
+	}
+	c.open.Do(func() {
+		c.stats.Open(c.key)
+		c.flushed = time.Now()
+	})
+	c.mu.Lock()
+	c.up += up
+	c.down += down
+	if time.Since(c.flushed) < statsFlushInterval {
+		c.mu.Unlock()
+		return
+	}
+	up, down = c.up, c.down
+	c.up, c.down, c.flushed = 0, 0, time.Now()
+	c.mu.Unlock()
+	c.stats.Add(c.key, up, down)
+}
+
+// flush 累计尚未记录的流量，连接结束时调用
+func (c *connStats) flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	up, down := c.up, c.down
+	c.up, c.down = 0, 0
+	c.mu.Unlock()
+	c.stats.Add(c.key, up, down)
+}
+
+func (u Usage) String() string {
+	return fmt.Sprintf("连接 %d，上行 %s，下行 %s", u.Connections, formatBytes(u.Upload), formatBytes(u.Download))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f%cB", value, "KMGTP"[exp])
+}
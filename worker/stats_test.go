@@ -0,0 +1,98 @@
+package worker
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// todayPeriod 今日的统计
+func todayPeriod(t *testing.T, s *TrafficStats) *UsagePeriod {
+	t.Helper()
+	period := s.Snapshot().Daily[time.Now().Format(time.DateOnly)]
+	if period == nil {
+		t.Fatal("今日无记录")
+	}
+	return period
+}
+
+func TestTrafficStatsDimensions(t *testing.T) {
+	s, err := NewTrafficStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := StatsKey{Client: "10.0.0.1", User: "alice", Domain: "example.com", Server: "a.workers.dev"}
+	anonymous := StatsKey{Client: "10.0.0.2", Domain: "example.com", Server: StatsDirect}
+	s.Open(alice)
+	s.Add(alice, 100, 200)
+	s.Open(anonymous)
+	s.Add(anonymous, 10, 20)
+
+	period := todayPeriod(t, s)
+	if period.Total != (Usage{Connections: 2, Upload: 110, Download: 220}) {
+		t.Errorf("合计 = %+v", period.Total)
+	}
+	if len(period.Users) != 1 || *period.Users["alice"] != (Usage{Connections: 1, Upload: 100, Download: 200}) {
+		t.Errorf("用户维度应只有 alice: %v", period.Users)
+	}
+	if *period.Domains["example.com"] != period.Total {
+		t.Errorf("域名维度 = %+v", period.Domains["example.com"])
+	}
+	if period.Servers[StatsDirect].Connections != 1 || period.Clients["10.0.0.2"].Upload != 10 {
+		t.Errorf("服务端 / 客户端维度错误: %v %v", period.Servers, period.Clients)
+	}
+}
+
+// TestConnStatsLive 连接期间的流量按间隔累计，不必等到连接结束
+func TestConnStatsLive(t *testing.T) {
+	s, err := NewTrafficStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConnStats(s, StatsKey{Client: "10.0.0.1", Domain: "example.com", Server: "a.workers.dev"})
+	c.add(5, 0)
+	if total := todayPeriod(t, s).Total; total != (Usage{Connections: 1}) {
+		t.Fatalf("建立时应只计入连接数: %+v", total)
+	}
+
+	// 距上次累计超过间隔后的下一次转发累计全部待记录的流量
+	c.mu.Lock()
+	c.flushed = time.Now().Add(-statsFlushInterval)
+	c.mu.Unlock()
+	c.add(0, 7)
+	if total := todayPeriod(t, s).Total; total != (Usage{Connections: 1, Upload: 5, Download: 7}) {
+		t.Fatalf("超过间隔后应累计流量: %+v", total)
+	}
+
+	c.add(3, 0)
+	c.flush()
+	if total := todayPeriod(t, s).Total; total != (Usage{Connections: 1, Upload: 8, Download: 7}) {
+		t.Fatalf("结束时应累计剩余流量: %+v", total)
+	}
+
+	disabled := newConnStats(nil, StatsKey{})
+	disabled.add(1, 1)
+	disabled.flush()
+}
+
+func TestTrafficStatsSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	s, err := NewTrafficStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := StatsKey{Client: "10.0.0.1", User: "alice", Domain: "example.com", Server: "a.workers.dev"}
+	s.Open(key)
+	s.Add(key, 1, 2)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewTrafficStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users := todayPeriod(t, loaded).Users; users["alice"] == nil || users["alice"].Download != 2 {
+		t.Errorf("重新加载后用户维度 = %v", users)
+	}
+}
@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/newde36524/ew/utils/log"
+)
+
+// TimeoutConfig 连接超时配置，0 为不限制
+type TimeoutConfig struct {
+	Idle        time.Duration // 隧道空闲超时（两个方向都没有数据）
+	MaxLifetime time.Duration // 隧道最长存活时间
+	Handshake   time.Duration // SOCKS5 / HTTP 握手（请求解析）超时
+	KeepAlive   time.Duration // 接入连接的 TCP keepalive 间隔，0 为关闭 keepalive
+}
+
+// 隧道关闭原因
+var (
+	errIdleTimeout      = errors.New("空闲超时")
+	errMaxLifetime      = errors.New("超过最长连接时间")
+	errClientClosed     = errors.New("客户端关闭")
+	errServerClosed     = errors.New("服务端关闭")
+	errHandshakeTimeout = errors.New("握手超时")
+)
+
+// setKeepAlive 设置接入连接的 TCP keepalive，period 为 0 时关闭（非 TCP 连接忽略）
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if period <= 0 {
+		tcpConn.SetKeepAlive(false) //nolint:errcheck
+		return
+	}
+	tcpConn.SetKeepAlive(true)         //nolint:errcheck
+	tcpConn.SetKeepAlivePeriod(period) //nolint:errcheck
+}
+
+// startHandshake 为 SOCKS5 / HTTP 请求解析设置超时，解析完成后由 finishHandshake 清除
+func (p *ProxyClient) startHandshake() {
+	if p.timeouts.Handshake <= 0 {
+		return
+	}
+	p.handshakeDeadline = time.Now().Add(p.timeouts.Handshake)
+	p.Conn.SetDeadline(p.handshakeDeadline) //nolint:errcheck
+}
+
+// finishHandshake 请求解析完成，清除握手超时
+func (p *ProxyClient) finishHandshake() {
+	if p.handshakeDeadline.IsZero() {
+		return
+	}
+	p.handshakeDeadline = time.Time{}
+	p.Conn.SetDeadline(time.Time{}) //nolint:errcheck
+}
+
+// logHandshakeTimeout 连接因握手超时结束时记录原因
+func (p *ProxyClient) logHandshakeTimeout() {
+	if !p.handshakeDeadline.IsZero() && !time.Now().Before(p.handshakeDeadline) {
+		log.Printf("[代理] %s 已断开: %v", p.clientAddr, errHandshakeTimeout)
+	}
+}
+
+// watchIdle 两个方向都超过 Idle 没有数据时调用 onIdle；返回的定时器需在隧道结束时停止
+func (p *ProxyClient) watchIdle(onIdle func()) *time.Timer {
+	idle := p.timeouts.Idle
+	p.touch()
+	var timer *time.Timer
+	timer = time.AfterFunc(idle, func() {
+		remaining := idle - time.Since(time.Unix(0, p.lastActive.Load()))
+		if remaining > 0 {
+			timer.Reset(remaining)
+			return
+		}
+		onIdle()
+	})
+	return timer
+}
+
+// touch 记录隧道活动时间
+func (p *ProxyClient) touch() {
+	p.lastActive.Store(time.Now().UnixNano())
+}
@@ -0,0 +1,332 @@
+//go:build linux
+
+package worker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/newde36524/ew/utils"
+	"github.com/newde36524/ew/utils/log"
+)
+
+const (
+	soOriginalDst         = 80 // SO_ORIGINAL_DST / IP6T_SO_ORIGINAL_DST
+	ipv6Transparent       = 75 // IPV6_TRANSPARENT
+	ipv6RecvOrigDstAddr   = 74 // IPV6_RECVORIGDSTADDR
+	udpSessionIdleTimeout = 60 * time.Second
+	acceptRetryDelay      = 100 * time.Millisecond
+)
+
+// runRedirServer 启动 REDIRECT 透明代理入口（iptables -j REDIRECT / nft redirect）
+func (p *ProxyServer) runRedirServer() error {
+	listener, err := net.Listen("tcp", p.RedirAddr)
+	if err != nil {
+		return fmt.Errorf("REDIRECT 监听失败: %w", err)
+	}
+	log.Printf("[透明代理] REDIRECT 入口启动: %s", p.RedirAddr)
+
+	go acceptTransparent(listener, func(conn net.Conn) {
+		dst, err := getOriginalDst(conn.(*net.TCPConn))
+		if err != nil {
+			log.Printf("[透明代理] %s 获取原始目标失败: %v", conn.RemoteAddr(), err)
+			conn.Close() //nolint:errcheck
+			return
+		}
+		p.handleTransparent(conn, dst)
+	})
+	return nil
+}
+
+// runTProxyServer 启动 TPROXY 透明代理入口（TCP + UDP）
+func (p *ProxyServer) runTProxyServer() error {
+	lc := net.ListenConfig{Control: transparentControl}
+
+	listener, err := lc.Listen(context.Background(), "tcp", p.TProxyAddr)
+	if err != nil {
+		return fmt.Errorf("TPROXY TCP 监听失败（需要 CAP_NET_ADMIN）: %w", err)
+	}
+	packetConn, err := lc.ListenPacket(context.Background(), "udp", p.TProxyAddr)
+	if err != nil {
+		listener.Close() //nolint:errcheck
+		return fmt.Errorf("TPROXY UDP 监听失败（需要 CAP_NET_ADMIN）: %w", err)
+	}
+	log.Printf("[透明代理] TPROXY 入口启动: %s (TCP+UDP)", p.TProxyAddr)
+
+	go acceptTransparent(listener, func(conn net.Conn) {
+		// TPROXY 模式下连接的本地地址即为原始目标地址
+		p.handleTransparent(conn, conn.LocalAddr().(*net.TCPAddr))
+	})
+
+	relay := &tproxyUDPRelay{
+		server:   p,
+		conn:     packetConn.(*net.UDPConn),
+		sessions: make(map[string]*tproxyUDPSession),
+	}
+	go relay.run()
+	return nil
+}
+
+// acceptTransparent 接受透明代理连接并在新协程中交给 handle，监听关闭时返回；
+// 其他错误（如文件描述符耗尽）等待 acceptRetryDelay 后重试，避免空转
+func acceptTransparent(listener net.Listener, handle func(net.Conn)) {
+	defer listener.Close() //nolint:errcheck
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("[透明代理] 接受连接失败: %v", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		go handle(conn)
+	}
+}
+
+// getOriginalDst 通过 SO_ORIGINAL_DST 读取 REDIRECT 之前的目标地址
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	isIPv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+
+	var dst *net.TCPAddr
+	var sockErr error
+	ctrlErr := rawConn.Control(func(fd uintptr) {
+		if isIPv4 {
+			// IPv6Mreq 恰好 20 字节，可以容纳 sockaddr_in（16 字节）
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			raw := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+				Port: int(binary.BigEndian.Uint16(raw[2:4])),
+			}
+			return
+		}
+		// IPv6MTUInfo 以 sockaddr_in6 开头，用于接收 IP6T_SO_ORIGINAL_DST
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		dst = &net.TCPAddr{
+			IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}
+	})
+	if ctrlErr != nil {
+		return nil, ctrlErr
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return dst, nil
+}
+
+// transparentControl 为 TPROXY 监听套接字设置 IP_TRANSPARENT 并开启原始目标地址回传
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+			return
+		}
+		isIPv6 := network == "tcp6" || network == "udp6" || !isIPv4Addr(address)
+		if isIPv6 {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1); sockErr != nil {
+				return
+			}
+		}
+		// 双栈套接字也需要设置 IPv4 选项，IPv6 单栈时忽略错误
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil && !isIPv6 {
+			sockErr = err
+			return
+		}
+		if network == "udp" || network == "udp4" || network == "udp6" {
+			if isIPv6 {
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1); sockErr != nil {
+					return
+				}
+			}
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil && !isIPv6 {
+				sockErr = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func isIPv4Addr(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() != nil
+}
+
+// parseOrigDstAddr 从 UDP 控制消息中解析原始目标地址
+func parseOrigDstAddr(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR && len(msg.Data) >= 8:
+			return &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr && len(msg.Data) >= 24:
+			return &net.UDPAddr{
+				IP:   append(net.IP(nil), msg.Data[8:24]...),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, errors.New("未找到原始目标地址")
+}
+
+// tproxyUDPRelay 处理 TPROXY 截获的 UDP 数据报
+type tproxyUDPRelay struct {
+	server     *ProxyServer
+	conn       *net.UDPConn
+	sessionsMu sync.Mutex
+	sessions   map[string]*tproxyUDPSession
+}
+
+// tproxyUDPSession 表示一个直连 UDP 会话（客户端地址 + 原始目标）
+type tproxyUDPSession struct {
+	remote net.Conn
+	reply  net.PacketConn
+}
+
+func (r *tproxyUDPRelay) run() {
+	defer r.conn.Close() //nolint:errcheck
+	buf := make([]byte, 65535)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, srcAddr, err := r.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			log.Printf("[透明代理] UDP 读取失败: %v", err)
+			return
+		}
+		dstAddr, err := parseOrigDstAddr(oob[:oobn])
+		if err != nil {
+			log.Printf("[透明代理] %s UDP 解析原始目标失败: %v", srcAddr, err)
+			continue
+		}
+		data := append([]byte(nil), buf[:n]...)
+		r.handlePacket(srcAddr, dstAddr, data)
+	}
+}
+
+func (r *tproxyUDPRelay) handlePacket(srcAddr, dstAddr *net.UDPAddr, data []byte) {
+	clientAddr := srcAddr.String()
+
+	// DNS 查询走 DoH（与 SOCKS5 UDP 一致）
+	if dstAddr.Port == 53 {
+		log.Printf("[透明代理-DNS] %s -> %s (内置 DNS)", clientAddr, dstAddr)
+		go func() {
+			resp, err := r.server.resolver.Respond(data)
+			if err != nil {
+				log.Printf("[透明代理-DNS] 查询失败: %v", err)
+			}
+			if resp == nil {
+				return
+			}
+			reply, err := dialTransparentUDP(dstAddr)
+			if err != nil {
+				log.Printf("[透明代理-DNS] 创建回包套接字失败: %v", err)
+				return
+			}
+			defer reply.Close() //nolint:errcheck
+			if _, err := reply.WriteTo(resp, srcAddr); err != nil {
+				log.Printf("[透明代理-DNS] 发送响应失败: %v", err)
+			}
+		}()
+		return
+	}
+
+	if !r.server.IPLoader.ShouldBypassProxy(dstAddr.IP.String()) {
+		// Worker 只能建立 TCP 连接，需要代理的 UDP（如 QUIC）只能丢弃，由应用回退到 TCP
+		log.Printf("[透明代理-UDP] %s -> %s (不支持代理非 DNS UDP，已丢弃)", clientAddr, dstAddr)
+		return
+	}
+
+	key := clientAddr + "|" + dstAddr.String()
+	r.sessionsMu.Lock()
+	session, ok := r.sessions[key]
+	if !ok {
+		remoteConn, err := utils.NewDialer(10*time.Second).Dial("udp", dstAddr.String())
+		if err != nil {
+			r.sessionsMu.Unlock()
+			log.Printf("[透明代理-UDP] %s -> %s 直连失败: %v", clientAddr, dstAddr, err)
+			return
+		}
+		reply, err := dialTransparentUDP(dstAddr)
+		if err != nil {
+			r.sessionsMu.Unlock()
+			remoteConn.Close() //nolint:errcheck
+			log.Printf("[透明代理-UDP] 创建回包套接字失败: %v", err)
+			return
+		}
+		session = &tproxyUDPSession{remote: remoteConn, reply: reply}
+		r.sessions[key] = session
+		log.Printf("[透明代理-UDP] %s -> %s (直连)", clientAddr, dstAddr)
+		go r.pipeReplies(key, session, srcAddr)
+	}
+	r.sessionsMu.Unlock()
+
+	if _, err := session.remote.Write(data); err != nil {
+		log.Printf("[透明代理-UDP] %s -> %s 发送失败: %v", clientAddr, dstAddr, err)
+	}
+}
+
+// pipeReplies 将直连目标的回包以原始目标地址为源发回客户端
+func (r *tproxyUDPRelay) pipeReplies(key string, session *tproxyUDPSession, srcAddr *net.UDPAddr) {
+	defer func() {
+		r.sessionsMu.Lock()
+		delete(r.sessions, key)
+		r.sessionsMu.Unlock()
+		session.remote.Close() //nolint:errcheck
+		session.reply.Close()  //nolint:errcheck
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		session.remote.SetReadDeadline(time.Now().Add(udpSessionIdleTimeout)) //nolint:errcheck
+		n, err := session.remote.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := session.reply.WriteTo(buf[:n], srcAddr); err != nil {
+			return
+		}
+	}
+}
+
+// dialTransparentUDP 创建绑定在原始目标地址上的透明 UDP 套接字，用于伪造回包源地址
+func dialTransparentUDP(addr *net.UDPAddr) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	return lc.ListenPacket(context.Background(), "udp", addr.String())
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package worker
+
+import "errors"
+
+var errTransparentUnsupported = errors.New("透明代理仅支持 Linux")
+
+func (p *ProxyServer) runRedirServer() error {
+	return errTransparentUnsupported
+}
+
+func (p *ProxyServer) runTProxyServer() error {
+	return errTransparentUnsupported
+}
@@ -0,0 +1,208 @@
+//go:build linux
+
+package worker
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/newde36524/ew/utils"
+	"github.com/newde36524/ew/utils/log"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	tunNICID    tcpip.NICID = 1
+	tunMark                 = 0x6577 // 出站连接 fwmark（"ew"）
+	tunTable                = 6577   // TUN 策略路由表
+	tunMaxInFly             = 2048   // TCP 半连接上限
+)
+
+// markTunOutbound 为自身出站连接打标记，配合策略路由避免回环（须在发起任何出站连接之前调用）
+func (p *ProxyServer) markTunOutbound() {
+	utils.SetOutboundMark(tunMark)
+}
+
+// runTunServer 创建 TUN 设备，用用户态协议栈终结其中的 TCP/UDP 流量并交给隧道逻辑
+func (p *ProxyServer) runTunServer() error {
+	cfg := p.Tun
+	if err := p.checkTunAddr(cfg.Addr); err != nil {
+		return err
+	}
+	fd, err := tun.Open(cfg.Name)
+	if err != nil {
+		return fmt.Errorf("打开 TUN 设备失败（需要 root 或 CAP_NET_ADMIN）: %w", err)
+	}
+	if err := utils.SetupTunDevice(cfg.Name, cfg.Addr, cfg.MTU); err != nil {
+		unix.Close(fd) //nolint:errcheck
+		return fmt.Errorf("配置 TUN 设备失败: %w", err)
+	}
+
+	linkEP, err := fdbased.New(&fdbased.Options{
+		FDs: []int{fd},
+		MTU: uint32(cfg.MTU),
+	})
+	if err != nil {
+		unix.Close(fd) //nolint:errcheck
+		return fmt.Errorf("创建 TUN 链路失败: %w", err)
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	// 关闭协议栈（停止读取设备）并关闭设备
+	closeTun := func() {
+		s.Close()
+		s.Wait()
+		unix.Close(fd) //nolint:errcheck
+	}
+	if tcpErr := s.CreateNIC(tunNICID, linkEP); tcpErr != nil {
+		closeTun()
+		return fmt.Errorf("创建协议栈网卡失败: %s", tcpErr)
+	}
+	// 接收发往任意地址的数据包，并允许以任意地址作为源地址回包
+	s.SetPromiscuousMode(tunNICID, true) //nolint:errcheck
+	s.SetSpoofing(tunNICID, true)        //nolint:errcheck
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNICID},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNICID},
+	})
+	sack := tcpip.TCPSACKEnabled(true)
+	s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack) //nolint:errcheck
+
+	tcpForwarder := tcp.NewForwarder(s, 0, tunMaxInFly, p.handleTunTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s, p.handleTunUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	if cfg.AutoRoute {
+		cleanup, err := utils.SetupTunRoutes(cfg.Name, tunTable, tunMark)
+		if err != nil {
+			closeTun()
+			return fmt.Errorf("配置 TUN 路由失败: %w", err)
+		}
+		utils.OnExit(cleanup)
+	}
+
+	log.Printf("[TUN] 设备 %s 已启动: %s, MTU %d, 自动路由: %v", cfg.Name, cfg.Addr, cfg.MTU, cfg.AutoRoute)
+	return nil
+}
+
+// checkTunAddr 检查 TUN 设备地址不在 fake-ip 地址段内：否则设备地址可能被分配给域名，
+// 发往它的连接被内核当作本机连接，不会进入 TUN
+func (p *ProxyServer) checkTunAddr(cidr string) error {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("无效的 TUN 设备地址: %w", err)
+	}
+	if p.resolver != nil && p.resolver.IsFakeIP() && p.resolver.fakeIP.Contains(ip) {
+		return fmt.Errorf("TUN 设备地址 %s 位于 fake-ip 地址段 %s 内，请修改 -tun-addr 或 -fake-ip-range", ip, p.resolver.fakeIP.ipNet)
+	}
+	return nil
+}
+
+// handleTunTCP 接管 TUN 中的 TCP 连接（由协议栈在独立 goroutine 中调用）
+func (p *ProxyServer) handleTunTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		log.Printf("[TUN] 创建 TCP 端点失败: %s", tcpErr)
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+
+	dst := &net.TCPAddr{IP: net.IP(id.LocalAddress.AsSlice()), Port: int(id.LocalPort)}
+	p.handleTransparent(gonet.NewTCPConn(&wq, ep), dst)
+}
+
+// handleTunUDP 接管 TUN 中的 UDP 流（由协议栈同步调用，不能阻塞）
+func (p *ProxyServer) handleTunUDP(r *udp.ForwarderRequest) {
+	id := r.ID()
+	var wq waiter.Queue
+	ep, udpErr := r.CreateEndpoint(&wq)
+	if udpErr != nil {
+		log.Printf("[TUN] 创建 UDP 端点失败: %s", udpErr)
+		return
+	}
+
+	conn := gonet.NewUDPConn(&wq, ep)
+	src := &net.UDPAddr{IP: net.IP(id.RemoteAddress.AsSlice()), Port: int(id.RemotePort)}
+	dst := &net.UDPAddr{IP: net.IP(id.LocalAddress.AsSlice()), Port: int(id.LocalPort)}
+	go p.relayTunUDP(conn, src, dst)
+}
+
+func (p *ProxyServer) relayTunUDP(conn *gonet.UDPConn, src, dst *net.UDPAddr) {
+	defer conn.Close() //nolint:errcheck
+	clientAddr := src.String()
+
+	// DNS 查询走 DoH（与 SOCKS5 UDP 一致）
+	if dst.Port == 53 {
+		buf := make([]byte, 65535)
+		for {
+			conn.SetReadDeadline(time.Now().Add(udpSessionIdleTimeout)) //nolint:errcheck
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			log.Printf("[TUN-DNS] %s -> %s (内置 DNS)", clientAddr, dst)
+			resp, err := p.resolver.Respond(buf[:n])
+			if err != nil {
+				log.Printf("[TUN-DNS] 查询失败: %v", err)
+			}
+			if resp == nil {
+				continue
+			}
+			if _, err := conn.Write(resp); err != nil {
+				return
+			}
+		}
+	}
+
+	if !p.IPLoader.ShouldBypassProxy(dst.IP.String()) {
+		// Worker 只能建立 TCP 连接，需要代理的 UDP（如 QUIC）只能丢弃，由应用回退到 TCP
+		log.Printf("[TUN-UDP] %s -> %s (不支持代理非 DNS UDP，已丢弃)", clientAddr, dst)
+		return
+	}
+
+	remote, err := utils.NewDialer(10*time.Second).Dial("udp", dst.String())
+	if err != nil {
+		log.Printf("[TUN-UDP] %s -> %s 直连失败: %v", clientAddr, dst, err)
+		return
+	}
+	defer remote.Close() //nolint:errcheck
+	log.Printf("[TUN-UDP] %s -> %s (直连)", clientAddr, dst)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dstConn, srcConn net.Conn) {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, 65535)
+		for {
+			srcConn.SetReadDeadline(time.Now().Add(udpSessionIdleTimeout)) //nolint:errcheck
+			n, err := srcConn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := dstConn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+	go pipe(remote, conn)
+	go pipe(conn, remote)
+	<-done
+}
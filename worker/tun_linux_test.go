@@ -0,0 +1,32 @@
+//go:build linux
+
+package worker
+
+import "testing"
+
+func TestCheckTunAddr(t *testing.T) {
+	pool, err := NewFakeIPPool("198.19.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ProxyServer{resolver: &Resolver{fakeIP: pool}}
+	for _, tc := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"198.18.0.1/15", true}, // 默认值：fake-ip 地址段位于 TUN 网段内，但不含设备地址
+		{"198.19.0.1/16", false},
+		{"10.0.0.1/24", true},
+		{"198.18.0.1", false}, // 缺少前缀长度
+	} {
+		if err := p.checkTunAddr(tc.addr); (err == nil) != tc.ok {
+			t.Errorf("checkTunAddr(%s) = %v", tc.addr, err)
+		}
+	}
+
+	// redir-host 模式不检查
+	p.resolver = &Resolver{}
+	if err := p.checkTunAddr("198.19.0.1/16"); err != nil {
+		t.Errorf("redir-host 模式不应检查: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+//go:build linux && netns
+
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newde36524/ew/utils/log"
+)
+
+// 命名空间测试的拓扑：
+//
+//	客户端命名空间（TUN 入口）ewv-c 10.200.0.1 <-veth-> ewv-t 10.200.0.2 目标命名空间（lo 上的 203.0.113.1）
+//
+// 客户端命名空间的默认路由指向 veth，启用自动路由后未打标记的流量进入 TUN，
+// TUN 入口按 None 分流直连目标，出站连接带 fwmark 走主路由表经 veth 到达目标
+const (
+	netnsRoleEnv   = "EW_NETNS_ROLE"
+	netnsTarget    = "203.0.113.1:7000"
+	netnsTunDevice = "ewtest0"
+	netnsTunAddr   = "198.18.0.1/15"
+)
+
+// TestTunNetns 在两个网络命名空间之间验证 TCP 与 UDP 经 TUN 入口转发（需要 root 与 ip 命令）
+//
+//	go test -tags netns -run TunNetns -v ./worker
+//
+// 测试在命名空间中重新执行自身：EW_NETNS_ROLE=target 运行回显目标，EW_NETNS_ROLE=tun 运行 TUN 入口与客户端
+func TestTunNetns(t *testing.T) {
+	switch os.Getenv(netnsRoleEnv) {
+	case "target":
+		runNetnsTarget(t)
+		return
+	case "tun":
+		runNetnsTun(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("需要 root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("需要 ip 命令")
+	}
+
+	suffix := fmt.Sprint(os.Getpid())
+	client, target := "ewtest-c-"+suffix, "ewtest-t-"+suffix
+	ip := func(args ...string) {
+		t.Helper()
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Fatalf("ip %s: %v: %s", strings.Join(args, " "), err, output)
+		}
+	}
+	for _, ns := range []string{client, target} {
+		ip("netns", "add", ns)
+		t.Cleanup(func() { exec.Command("ip", "netns", "del", ns).Run() }) //nolint:errcheck
+		ip("-n", ns, "link", "set", "lo", "up")
+	}
+	ip("link", "add", "ewv-c", "netns", client, "type", "veth", "peer", "name", "ewv-t", "netns", target)
+	ip("-n", client, "addr", "add", "10.200.0.1/24", "dev", "ewv-c")
+	ip("-n", client, "link", "set", "ewv-c", "up")
+	ip("-n", client, "route", "add", "default", "via", "10.200.0.2")
+	ip("-n", target, "addr", "add", "10.200.0.2/24", "dev", "ewv-t")
+	ip("-n", target, "link", "set", "ewv-t", "up")
+	ip("-n", target, "addr", "add", "203.0.113.1/32", "dev", "lo")
+
+	// 目标：输出 ready 后一直运行，测试结束时结束进程
+	targetCmd := netnsCommand(target, "target")
+	stdout, err := targetCmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := targetCmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		targetCmd.Process.Kill() //nolint:errcheck
+		targetCmd.Wait()         //nolint:errcheck
+	})
+	ready := make(chan bool, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if scanner.Text() == "ready" {
+				ready <- true
+				io.Copy(io.Discard, stdout) //nolint:errcheck
+				return
+			}
+		}
+		ready <- false
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			t.Fatal("目标启动失败")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("目标启动超时")
+	}
+
+	output, err := netnsCommand(client, "tun").CombinedOutput()
+	if err != nil {
+		t.Fatalf("TUN 入口测试失败: %v\n%s", err, output)
+	}
+	t.Logf("%s", output)
+}
+
+// netnsCommand 在命名空间中以指定角色重新执行本测试
+func netnsCommand(ns, role string) *exec.Cmd {
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestTunNetns$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsRoleEnv+"="+role)
+	return cmd
+}
+
+// runNetnsTarget 在目标命名空间中运行 TCP 与 UDP 回显服务
+func runNetnsTarget(t *testing.T) {
+	listener, err := net.Listen("tcp", netnsTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetConn, err := net.ListenPacket("udp", netnsTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packetConn.WriteTo(buf[:n], addr) //nolint:errcheck
+		}
+	}()
+	fmt.Println("ready")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()  //nolint:errcheck
+			io.Copy(conn, conn) //nolint:errcheck
+		}()
+	}
+}
+
+// runNetnsTun 在客户端命名空间中启动 TUN 入口，经 TUN 连接目标
+func runNetnsTun(t *testing.T) {
+	log.IsShow = testing.Verbose()
+	p := &ProxyServer{
+		IPLoader: NewIPLoader(None),
+		Tun:      &TunConfig{Name: netnsTunDevice, Addr: netnsTunAddr, MTU: 1500, AutoRoute: true},
+	}
+	p.markTunOutbound()
+	if err := p.runTunServer(); err != nil {
+		t.Fatal(err)
+	}
+	tunIP, _, _ := net.ParseCIDR(netnsTunAddr)
+
+	t.Run("tcp", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", netnsTarget, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close() //nolint:errcheck
+		// 进入 TUN 的连接以 TUN 设备地址为源地址
+		if local := conn.LocalAddr().(*net.TCPAddr).IP; !local.Equal(tunIP) {
+			t.Fatalf("连接未经过 TUN，源地址 %s", local)
+		}
+		checkEcho(t, conn, "hello over tun")
+		conn.(*net.TCPConn).CloseWrite()                      //nolint:errcheck
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+		if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Fatalf("半关闭后应读到 EOF: %d, %v", n, err)
+		}
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		conn, err := net.Dial("udp", netnsTarget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close() //nolint:errcheck
+		if local := conn.LocalAddr().(*net.UDPAddr).IP; !local.Equal(tunIP) {
+			t.Fatalf("数据报未经过 TUN，源地址 %s", local)
+		}
+		checkEcho(t, conn, "datagram over tun")
+	})
+}
+
+func checkEcho(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("回显 = %q, %v", buf, err)
+	}
+}
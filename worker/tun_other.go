@@ -0,0 +1,11 @@
+//go:build !linux
+
+package worker
+
+import "errors"
+
+func (p *ProxyServer) markTunOutbound() {}
+
+func (p *ProxyServer) runTunServer() error {
+	return errors.New("TUN 入口仅支持 Linux")
+}
@@ -0,0 +1,224 @@
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/newde36524/ew/utils"
+	"github.com/newde36524/ew/utils/log"
+)
+
+// WSPoolConfig 预热连接池配置（每个服务端一个池）
+type WSPoolConfig struct {
+	MinIdle      int           // 保持的最少空闲连接数，0 为不启用连接池
+	MaxIdle      int           // 最多空闲连接数，连接池取空时逐步增加预热数量，不超过该值
+	MaxAge       time.Duration // 空闲连接的最长存活时间，超过后关闭并重新预热
+	PingInterval time.Duration // 空闲连接的保活间隔
+}
+
+const wsPoolPingTimeout = 5 * time.Second
+
+type pooledWS struct {
+	ws        *utils.WebSocketWrap
+	createdAt time.Time
+}
+
+// wsPool 已完成 ECH 与 WebSocket 握手的空闲连接，建立隧道时只需发送 CONNECT
+//
+// 预热数量从 MinIdle 开始，每次取空时加一（不超过 MaxIdle），一个保活周期内没有取用时减一
+type wsPool struct {
+	config WSPoolConfig
+	name   string
+	dial   func() (*utils.WebSocketWrap, error)
+
+	mu      sync.Mutex
+	idle    []pooledWS // 按创建时间排序，最新的在末尾
+	target  int        // 当前预热数量
+	dialing bool
+	used    bool // 本保活周期内是否取用过
+	closed  bool
+
+	refill chan struct{}
+	stop   chan struct{}
+}
+
+// newWSPool 创建连接池并开始预热，MinIdle 为 0 时返回 nil（nil 连接池可安全调用）
+func newWSPool(name string, config WSPoolConfig, dial func() (*utils.WebSocketWrap, error)) *wsPool {
+	if config.MinIdle <= 0 {
+		return nil
+	}
+	if config.MaxIdle < config.MinIdle {
+		config.MaxIdle = config.MinIdle
+	}
+	if config.PingInterval <= 0 {
+		config.PingInterval = 10 * time.Second
+	}
+	p := &wsPool{
+		config: config,
+		name:   name,
+		dial:   dial,
+		target: config.MinIdle,
+		refill: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	go p.run()
+	p.notify()
+	return p
+}
+
+// Get 取出最新的一个空闲连接，没有可用连接时返回 nil
+func (p *wsPool) Get() *utils.WebSocketWrap {
+	if p == nil {
+		return nil
+	}
+	var expired []pooledWS
+	var ws *utils.WebSocketWrap
+	p.mu.Lock()
+	p.used = true
+	for len(p.idle) != 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.expired(c) || c.ws.Broken() {
+			expired = append(expired, c)
+			continue
+		}
+		ws = c.ws
+		break
+	}
+	if ws == nil && p.target < p.config.MaxIdle {
+		p.target++
+	}
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		c.ws.Close() //nolint:errcheck
+	}
+	p.notify()
+	return ws
+}
+
+// Close 停止预热并关闭所有空闲连接
+func (p *wsPool) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.stop)
+	for _, c := range idle {
+		c.ws.Close() //nolint:errcheck
+	}
+}
+
+func (p *wsPool) expired(c pooledWS) bool {
+	return p.config.MaxAge > 0 && time.Since(c.createdAt) > p.config.MaxAge
+}
+
+func (p *wsPool) notify() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (p *wsPool) run() {
+	ticker := time.NewTicker(p.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.refill:
+			p.fill()
+		case <-ticker.C:
+			p.keepAlive()
+			p.fill()
+		}
+	}
+}
+
+// fill 逐个建立连接直到达到预热数量，失败时等待下一个保活周期再试
+func (p *wsPool) fill() {
+	for {
+		p.mu.Lock()
+		if p.closed || p.dialing || len(p.idle) >= p.target {
+			p.mu.Unlock()
+			return
+		}
+		p.dialing = true
+		p.mu.Unlock()
+
+		ws, err := p.dial()
+
+		p.mu.Lock()
+		p.dialing = false
+		if err == nil && !p.closed {
+			// 空闲期间由后台读取处理 pong，失效的连接不会被取出
+			ws.ReadInBackground()
+			p.idle = append(p.idle, pooledWS{ws: ws, createdAt: time.Now()})
+			ws = nil
+		}
+		closed := p.closed
+		p.mu.Unlock()
+
+		if ws != nil {
+			ws.Close() //nolint:errcheck
+		}
+		if err != nil {
+			if !closed {
+				log.Printf("[连接池] 服务端 %s 预热连接失败: %v", p.name, err)
+			}
+			return
+		}
+	}
+}
+
+// keepAlive 向空闲连接发送 ping（pong 由连接的后台读取处理，超时未收到时连接变为 Broken），
+// 关闭失效和过期的连接，并在空闲时回落预热数量
+func (p *wsPool) keepAlive() {
+	p.mu.Lock()
+	snapshot := append([]pooledWS(nil), p.idle...)
+	if !p.used && p.target > p.config.MinIdle {
+		p.target--
+	}
+	p.used = false
+	p.mu.Unlock()
+
+	// ping 在锁外进行（WriteControl 可与取走后的读写并发），期间连接仍可被 Get 取走
+	dead := map[*utils.WebSocketWrap]bool{}
+	for _, c := range snapshot {
+		if p.expired(c) || c.ws.Broken() || c.ws.Ping(wsPoolPingTimeout) != nil {
+			dead[c.ws] = true
+		}
+	}
+
+	var discard []pooledWS
+	p.mu.Lock()
+	alive := p.idle[:0]
+	for _, c := range p.idle {
+		if dead[c.ws] {
+			discard = append(discard, c)
+			continue
+		}
+		alive = append(alive, c)
+	}
+	p.idle = alive
+	// 超出预热数量的部分关闭最旧的连接
+	if n := len(p.idle) - p.target; n > 0 {
+		discard = append(discard, p.idle[:n]...)
+		p.idle = append([]pooledWS(nil), p.idle[n:]...)
+	}
+	p.mu.Unlock()
+
+	for _, c := range discard {
+		c.ws.Close() //nolint:errcheck
+	}
+}
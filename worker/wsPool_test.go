@@ -0,0 +1,117 @@
+package worker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/newde36524/ew/utils"
+)
+
+func poolDialer(server *httptest.Server) func() (*utils.WebSocketWrap, error) {
+	return func() (*utils.WebSocketWrap, error) {
+		header := http.Header{utils.TunnelVersionHeader: []string{strconv.Itoa(utils.TunnelV2)}}
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+		if err != nil {
+			return nil, err
+		}
+		return utils.NewWebSocketWrap(conn, utils.NegotiatedTunnelVersion(resp)), nil
+	}
+}
+
+// waitIdle 等待连接池中有 n 个空闲连接
+func waitIdle(t *testing.T, pool *wsPool, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		pool.mu.Lock()
+		idle := len(pool.idle)
+		pool.mu.Unlock()
+		if idle >= n {
+			return
+		}
+	}
+	t.Fatalf("连接池未预热到 %d 个连接", n)
+}
+
+// TestWSPoolLiveConn 取出的预热连接可以正常建立隧道（CONNECT 响应经由后台读取取得）
+func TestWSPoolLiveConn(t *testing.T) {
+	worker := newFakeWorker(t)
+	pool := newWSPool("test", WSPoolConfig{MinIdle: 1, MaxIdle: 1}, poolDialer(worker))
+	defer pool.Close()
+	waitIdle(t, pool, 1)
+
+	ws := pool.Get()
+	if ws == nil {
+		t.Fatal("连接池为空")
+	}
+	defer ws.Close() //nolint:errcheck
+	if err := ws.SendConnect("example.com:80", nil, utils.ModeSOCKS5); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteData([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ws.ReadData(); err != nil || string(data) != "ping" {
+		t.Fatalf("ReadData = %q, %v", data, err)
+	}
+}
+
+// TestWSPoolSkipsClosedConn 对端关闭的空闲连接由后台读取发现，不会被取出
+func TestWSPoolSkipsClosedConn(t *testing.T) {
+	var mu sync.Mutex
+	var conns []*websocket.Conn
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	pool := newWSPool("test", WSPoolConfig{MinIdle: 2, MaxIdle: 2, PingInterval: time.Hour}, poolDialer(server))
+	defer pool.Close()
+	waitIdle(t, pool, 2)
+
+	// 服务端关闭所有连接（如 Worker 重新部署）
+	mu.Lock()
+	idle := append([]*websocket.Conn(nil), conns...)
+	mu.Unlock()
+	for _, conn := range idle {
+		conn.Close() //nolint:errcheck
+	}
+	pool.mu.Lock()
+	pooled := append([]pooledWS(nil), pool.idle...)
+	pool.mu.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		broken := 0
+		for _, c := range pooled {
+			if c.ws.Broken() {
+				broken++
+			}
+		}
+		if broken == len(pooled) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("后台读取未发现已关闭的连接")
+		}
+	}
+
+	if ws := pool.Get(); ws != nil {
+		for _, c := range pooled {
+			if c.ws == ws {
+				t.Fatal("取出了已关闭的连接")
+			}
+		}
+		ws.Close() //nolint:errcheck
+	}
+}